@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dumie-org/dumie-cli/internal/agent"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	agentLogFileFlag        string
+	agentLockTableFlag      string
+	agentDefaultTimeoutFlag int
+	agentHooksDirFlag       string
+	agentHookTimeoutFlag    time.Duration
+)
+
+// agentCmd runs the on-instance monitor that archives and terminates idle instances
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run the on-instance agent that archives the instance when it is no longer in use",
+	Long: `Run the Dumie agent on a managed instance. The agent reads its archive policy
+(idle timeout, TTL, schedule and pin) from the instance tags, snapshots the instance when the
+policy says so and terminates it.
+
+Executable hooks in <hooks-dir>/pre-archive run before every archive; a hook exiting non-zero
+vetoes the archive. Hooks in <hooks-dir>/post-restore run once on the first boot of an instance
+restored from a snapshot. Each hook's exit status is recorded in the lock table.
+
+It is installed as a systemd unit by the instance user data
+and is not meant to be run on a workstation.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Canceled on SIGTERM when systemd stops the unit
+		ctx := cmd.Context()
+
+		logTail := agent.NewLogBuffer(agent.DefaultLogBufferLines)
+		var output io.Writer = io.MultiWriter(os.Stderr, logTail)
+		if agentLogFileFlag != "" {
+			logFile, err := os.OpenFile(agentLogFileFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Printf("Failed to open agent log file: %v\n", err)
+				os.Exit(1)
+			}
+			defer logFile.Close()
+			output = io.MultiWriter(os.Stderr, logFile, logTail)
+		}
+		logger := log.New(output, "", log.LstdFlags)
+
+		cfg, err := common.GetInstanceAWSConfig(ctx)
+		if err != nil {
+			logger.Printf("Failed to load AWS config: %v", err)
+			os.Exit(1)
+		}
+
+		a := agent.New(cfg, agentLockTableFlag, logger)
+		a.DefaultTimeoutSeconds = agentDefaultTimeoutFlag
+		a.LogTail = logTail
+		a.Hooks = &agent.DirHookRunner{Dir: agentHooksDirFlag, Timeout: agentHookTimeoutFlag}
+		if err := a.Run(ctx); err != nil {
+			logger.Printf("Agent stopped: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	agentCmd.Flags().StringVar(&agentLogFileFlag, "log-file", "/var/log/dumie-agent.log", "File the agent appends its log to, in addition to stderr")
+	agentCmd.Flags().StringVar(&agentLockTableFlag, "lock-table", ddb.DefaultTableName, "DynamoDB table holding Dumie locks")
+	agentCmd.Flags().IntVar(&agentDefaultTimeoutFlag, "default-timeout", ec2utils.DefaultTimeoutSeconds, "Idle timeout in seconds when the instance has no TimeoutSeconds tag")
+	agentCmd.Flags().StringVar(&agentHooksDirFlag, "hooks-dir", agent.DefaultHooksDir, "Directory with pre-archive/ and post-restore/ hook sub-directories")
+	agentCmd.Flags().DurationVar(&agentHookTimeoutFlag, "hook-timeout", agent.DefaultHookTimeout, "Maximum run time of a single hook")
+	rootCmd.AddCommand(agentCmd)
+}
@@ -11,21 +11,15 @@ import (
 
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
 	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/dumie-org/dumie-cli/internal/aws/iam"
 	"github.com/spf13/cobra"
 )
 
-type AWSConfig struct {
-	AccessKeyID     string `json:"aws_access_key_id"`
-	SecretAccessKey string `json:"aws_secret_access_key"`
-	Region          string `json:"aws_region"`
-	KeyPairName     string `json:"key_pair_name"`
-}
+// AWSConfig is the config file layout shared with the internal packages
+type AWSConfig = common.AWSConfig
 
-const (
-	lockTableName    = "dumie-lock-table"
-	defaultAWSRegion = "us-east-1"
-)
+const defaultAWSRegion = "us-east-1"
 
 func loadConfig() (*AWSConfig, error) {
 	config := &AWSConfig{}
@@ -62,7 +56,7 @@ func promptForInput(prompt, defaultValue string) string {
 	return input
 }
 
-func configureDynamoDBLockTable() error {
+func configureDynamoDBLockTable(ctx context.Context) error {
 	fmt.Println("Now initializing DynamoDB lock table...")
 
 	client, err := common.GetDynamoDBClient()
@@ -77,14 +71,19 @@ func configureDynamoDBLockTable() error {
 		return err
 	}
 
+	lock := ddb.NewDynamoDBLock(client)
+
 	if isTableExists {
-		fmt.Println("DynamoDB lock table already exists. Skipping creation.")
+		// Tables created by older versions keep expired items forever
+		fmt.Printf("DynamoDB lock table %s already exists. Checking Time to Live...\n", lock.TableName)
+		if err := lock.EnableTTL(ctx); err != nil {
+			fmt.Printf("Error enabling Time to Live on the lock table: %v\n", err)
+			return err
+		}
 		return nil
 	}
 
-	lock := ddb.NewDynamoDBLock(client)
-
-	err = lock.CreateLockTable(context.Background())
+	err = lock.CreateLockTable(ctx)
 	if err != nil {
 		fmt.Printf("Error creating DynamoDB lock table: %v\n", err)
 		return err
@@ -130,7 +129,7 @@ func configureEC2KeyPair() error {
 	return nil
 }
 
-func configureIAMRole() error {
+func configureIAMRole(lockTable string) error {
 	fmt.Println("Configuring IAM role for instance management...")
 
 	client, err := common.GetIAMClient()
@@ -138,7 +137,7 @@ func configureIAMRole() error {
 		return fmt.Errorf("error creating IAM client: %v", err)
 	}
 
-	err = iam.CreateInstanceManagerRole(client)
+	err = iam.CreateInstanceManagerRole(client, lockTable)
 	if err != nil {
 		return fmt.Errorf("error creating IAM role: %v", err)
 	}
@@ -164,12 +163,37 @@ var configureCmd = &cobra.Command{
 		if awsRegion == "" {
 			awsRegion = defaultAWSRegion
 		}
+		encryption := promptForInput("Enter volume encryption (none, default or KMS key ARN)", config.Encryption)
+		if _, err := ec2utils.ParseEncryption(encryption); err != nil {
+			fmt.Println(err)
+			return
+		}
+		lockTable := promptForInput("Enter DynamoDB lock table name", config.LockTableName())
+		allowedIP := config.AllowedIP
+		if allowedIP == "" {
+			allowedIP = "auto"
+		}
+		allowedIP = promptForInput("Enter the IP or CIDR allowed to SSH (auto to detect)", allowedIP)
+		if allowedIP != "auto" {
+			if _, err := common.ParseCIDR(allowedIP); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
 
-		newConfig := AWSConfig{
-			AccessKeyID:     awsAccessKeyID,
-			SecretAccessKey: awsSecretAccessKey,
-			Region:          awsRegion,
-			KeyPairName:     config.KeyPairName,
+		// Keep settings that are not prompted for, such as the key pair and user data template
+		newConfig := *config
+		newConfig.AccessKeyID = awsAccessKeyID
+		newConfig.SecretAccessKey = awsSecretAccessKey
+		newConfig.Region = awsRegion
+		newConfig.Encryption = encryption
+		newConfig.LockTable = ""
+		if lockTable != common.DefaultLockTable {
+			newConfig.LockTable = lockTable
+		}
+		newConfig.AllowedIP = ""
+		if allowedIP != "auto" {
+			newConfig.AllowedIP = allowedIP
 		}
 
 		file, err := os.Create(common.ConfigFilePath)
@@ -187,7 +211,7 @@ var configureCmd = &cobra.Command{
 
 		fmt.Println("Configuration saved successfully.")
 
-		err = configureDynamoDBLockTable()
+		err = configureDynamoDBLockTable(cmd.Context())
 		if err != nil {
 			fmt.Printf("Error configuring DynamoDB lock table: %v\n", err)
 			return
@@ -199,7 +223,7 @@ var configureCmd = &cobra.Command{
 			return
 		}
 
-		err = configureIAMRole()
+		err = configureIAMRole(newConfig.LockTableName())
 		if err != nil {
 			fmt.Printf("Error configuring IAM role: %v\n", err)
 			return
@@ -4,11 +4,9 @@ Copyright © 2025 Chanhyeok Seo chanhyeok.seo2@gmail.com
 package cmd
 
 import (
-	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
@@ -24,7 +22,7 @@ var connectCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := args[0]
 
-		ec2Client, err := common.GetEC2AWSClient()
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
 		if err != nil {
 			fmt.Printf("Failed to create EC2 client: %v\n", err)
 			return
@@ -41,7 +39,7 @@ var connectCmd = &cobra.Command{
 		}
 		instanceID := *instanceIDPtr
 
-		instanceDetails, err := ec2Client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+		instanceDetails, err := ec2Client.DescribeInstances(cmd.Context(), &ec2.DescribeInstancesInput{
 			InstanceIds: []string{instanceID},
 		})
 		if err != nil {
@@ -67,30 +65,21 @@ var connectCmd = &cobra.Command{
 			return
 		}
 
-		keyPairName, err := common.GetKeyPairName()
-		if err != nil {
-			fmt.Printf("Failed to get key pair name: %v\n", err)
+		if err := allowSSHFromHere(cmd.Context(), ec2Client, instanceID); err != nil {
+			fmt.Printf("Failed to allow SSH access from this machine: %v\n", err)
 			return
 		}
 
-		keyFilePath := filepath.Join(".", fmt.Sprintf("%s.pem", keyPairName))
-		if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
-			fmt.Printf("Private key file not found: %s\n", keyFilePath)
-			fmt.Println("Make sure the key file exists in the current directory.")
+		sshCmdArgs, err := sshArgs(cmd.Context(), ec2Client, sshTarget{Profile: profile, InstanceID: instanceID, PublicDNS: publicDNS}, nil)
+		if err != nil {
+			fmt.Println(err)
 			return
 		}
 
-		sshArgs := []string{
-			"-i", keyFilePath,
-			"-o", "StrictHostKeyChecking=no",
-			"-o", "UserKnownHostsFile=/dev/null",
-			fmt.Sprintf("ec2-user@%s", publicDNS),
-		}
-
 		fmt.Printf("Connecting to instance [%s] at %s...\n", instanceID, publicDNS)
-		fmt.Printf("SSH command: ssh %v\n", sshArgs)
+		fmt.Printf("SSH command: ssh %v\n", sshCmdArgs)
 
-		sshCmd := exec.Command("ssh", sshArgs...)
+		sshCmd := exec.Command("ssh", sshCmdArgs...)
 		sshCmd.Stdin = os.Stdin
 		sshCmd.Stdout = os.Stdout
 		sshCmd.Stderr = os.Stderr
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
 	"github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/spf13/cobra"
 )
@@ -16,10 +17,17 @@ var deleteCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := args[0]
-		ctx := context.TODO()
+		ctx := cmd.Context()
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "delete")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
 
 		// Create EC2 Client
-		ec2Client, err := common.GetEC2AWSClient()
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
 		if err != nil {
 			fmt.Println("Failed to create EC2 client:", err)
 			return
@@ -37,18 +45,24 @@ var deleteCmd = &cobra.Command{
 		}
 		instanceID := *instanceIDPtr
 
-		// Get root volume ID
-		volumeID, err := ec2.GetRootVolumeID(ctx, ec2Client, instanceID)
+		registry, err := newRegistry(profile)
 		if err != nil {
-			fmt.Println("Failed to get root volume ID:", err)
-			return
+			fmt.Printf("Warning: cannot record profile state: %v\n", err)
 		}
 
-		// Create snapshot with tag Name = profile
-		snapshotMgr := ec2.NewSnapshotManagerFromClient(ec2Client)
-		snapshotID, err := snapshotMgr.CreateSnapshot(ctx, volumeID, instanceID, profile)
+		// Archive the root volume and wait until the snapshot is restorable
+		recordState(ctx, registry, profile, ddb.StateArchiving, ddb.RecordUpdate{InstanceID: instanceID})
+		fmt.Printf("Archiving instance [%s] (profile: %s)...\n", instanceID, profile)
+		snapshotID, err := ec2.Archive(ctx, ec2Client, ec2.ArchiveOptions{
+			Profile:    profile,
+			InstanceID: instanceID,
+			Source:     ec2.ArchiveSourceCLI,
+			Reason:     "deleted with dumie delete",
+			Logger:     warnings,
+		})
 		if err != nil {
-			fmt.Println("Failed to create snapshot:", err)
+			recordState(context.WithoutCancel(ctx), registry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: instanceID, Error: err.Error()})
+			fmt.Printf("Archive of instance [%s] failed, keeping the instance: %v\n", instanceID, err)
 			return
 		}
 		fmt.Printf("Snapshot [%s] successfully created for instance [%s] (profile: %s)\n", snapshotID, instanceID, profile)
@@ -56,9 +70,11 @@ var deleteCmd = &cobra.Command{
 		// Terminate instance
 		err = ec2.TerminateInstance(ctx, ec2Client, instanceID)
 		if err != nil {
+			recordState(context.WithoutCancel(ctx), registry, profile, ddb.StateFailed, ddb.RecordUpdate{InstanceID: instanceID, SnapshotID: snapshotID, Error: err.Error()})
 			fmt.Println("Failed to terminate instance:", err)
 			return
 		}
+		recordState(ctx, registry, profile, ddb.StateArchived, ddb.RecordUpdate{SnapshotID: snapshotID})
 		fmt.Printf("Instance [%s] (profile: %s) terminated successfully.\n", instanceID, profile)
 	},
 }
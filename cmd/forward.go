@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// forwardRetryBase and forwardRetryMax bound the wait between reconnects of a tunnel
+	forwardRetryBase = time.Second
+	forwardRetryMax  = 30 * time.Second
+
+	// forwardStableAfter is how long a tunnel must stay up for the next reconnect to start over
+	// from forwardRetryBase
+	forwardStableAfter = time.Minute
+)
+
+var forwardRemoteFlag []string
+
+// forwardCmd keeps SSH tunnels to the instance of a profile open
+var forwardCmd = &cobra.Command{
+	Use:   "forward [profile] [port[:host:hostport]]...",
+	Short: "Forward ports to and from a profile's instance over SSH",
+	Long: `Forward local ports to the instance of a profile over SSH. A bare port forwards the same
+port on the instance, port:host:hostport forwards to host:hostport as seen from the instance.
+Use -R port[:host:hostport] to forward a port of the instance back to this machine instead.
+
+The tunnel is reconnected automatically when it drops and counts as an SSH session, so the
+instance is not archived as idle while it is open. Press Ctrl-C to close it.`,
+	Example: `  dumie forward dev 8080
+  dumie forward dev 8080 5432:db.internal:5432
+  dumie forward dev -R 9000`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		var options []string
+		for _, spec := range args[1:] {
+			forward, err := forwardSpec(spec)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			options = append(options, "-L", forward)
+		}
+		for _, spec := range forwardRemoteFlag {
+			forward, err := forwardSpec(spec)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			options = append(options, "-R", forward)
+		}
+		if len(options) == 0 {
+			fmt.Println("Give at least one port to forward, or -R for a reverse forward")
+			return
+		}
+		options = append(options,
+			"-N",
+			"-o", "ExitOnForwardFailure=yes",
+			"-o", "ServerAliveInterval=15",
+			"-o", "ServerAliveCountMax=3",
+		)
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		wait := forwardRetryBase
+		for {
+			started := time.Now()
+			err := runTunnel(ctx, ec2Client, profile, options)
+			if ctx.Err() != nil {
+				fmt.Println("Tunnel closed.")
+				return
+			}
+			if errors.Is(err, errNoInstance) {
+				fmt.Printf("No running instance found for profile [%s], closing the tunnel\n", profile)
+				return
+			}
+			if errors.Is(err, errHostKeyMismatch) {
+				fmt.Println(err)
+				return
+			}
+
+			if time.Since(started) >= forwardStableAfter {
+				wait = forwardRetryBase
+			}
+			fmt.Printf("Tunnel dropped (%v), reconnecting in %s...\n", err, wait)
+			select {
+			case <-ctx.Done():
+				fmt.Println("Tunnel closed.")
+				return
+			case <-time.After(wait):
+			}
+			wait = min(wait*2, forwardRetryMax)
+		}
+	},
+}
+
+// errNoInstance stops the reconnects of a tunnel whose instance is gone
+var errNoInstance = errors.New("no running instance")
+
+// runTunnel looks the instance up again, so a tunnel follows a profile that was archived and
+// restored, and runs ssh until it exits
+func runTunnel(ctx context.Context, client *ec2.Client, profile string, options []string) error {
+	instanceIDPtr, err := ec2utils.SearchEC2Instance(client, profile)
+	if err != nil {
+		return fmt.Errorf("failed to find instance: %w", err)
+	}
+	if instanceIDPtr == nil {
+		return errNoInstance
+	}
+	instanceID := *instanceIDPtr
+
+	publicDNS, err := ec2utils.GetInstancePublicDNS(client, instanceID)
+	if err != nil {
+		return err
+	}
+	if publicDNS == "" {
+		return fmt.Errorf("instance [%s] has no public DNS name", instanceID)
+	}
+
+	// The public IP of this machine may have changed since the tunnel dropped
+	if err := allowSSHFromHere(ctx, client, instanceID); err != nil {
+		return err
+	}
+
+	args, err := sshArgs(ctx, client, sshTarget{Profile: profile, InstanceID: instanceID, PublicDNS: publicDNS}, options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Forwarding through instance [%s] at %s...\n", instanceID, publicDNS)
+	sshCmd := exec.CommandContext(ctx, "ssh", args...)
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	if err := sshCmd.Run(); err != nil {
+		return err
+	}
+	return errors.New("ssh exited")
+}
+
+// forwardSpec turns port or port:host:hostport into the argument of ssh -L or -R. A bare port
+// forwards to the same port on localhost of the other side.
+func forwardSpec(spec string) (string, error) {
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		parts = []string{parts[0], "localhost", parts[0]}
+	case 3:
+	default:
+		return "", fmt.Errorf("invalid forward %q (expected port or port:host:hostport)", spec)
+	}
+
+	for _, port := range []string{parts[0], parts[2]} {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port %q in forward %q", port, spec)
+		}
+	}
+	if parts[1] == "" {
+		return "", fmt.Errorf("missing host in forward %q", spec)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+func init() {
+	forwardCmd.Flags().StringArrayVarP(&forwardRemoteFlag, "remote", "R", nil, "Forward a port of the instance back to this machine (port[:host:hostport]), repeatable")
+	rootCmd.AddCommand(forwardCmd)
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcDryRunFlag bool
+	gcYesFlag    bool
+)
+
+// gcLockItem is the kind of the expired lock table items gc removes
+const gcLockItem = "lock-item"
+
+// gcItem is one leftover resource in one region
+type gcItem struct {
+	Region string
+	Orphan ec2utils.Orphan
+}
+
+// gcCmd removes resources Dumie left behind in every region it manages profiles in
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find and remove orphaned Dumie resources",
+	Long: `Find AMIs no instance uses, snapshots that belong to no profile, expired lock table
+items and unused Dumie security groups, show what each costs and remove them after confirmation.
+Resources younger than a few hours are skipped so archives in progress are left alone.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+
+		var items []gcItem
+		ec2Clients := map[string]*ec2.Client{}
+		locks := map[string]*ddb.DynamoDBLock{}
+		for _, region := range managedRegions(cfg) {
+			ec2Client, err := common.GetEC2ClientForRegion(region)
+			if err != nil {
+				fmt.Printf("Failed to create EC2 client for %s: %v\n", region, err)
+				return
+			}
+			ec2Clients[region] = ec2Client
+
+			orphans, err := ec2utils.FindOrphans(ctx, ec2Client)
+			if err != nil {
+				fmt.Printf("Failed to scan %s: %v\n", region, err)
+				return
+			}
+			for _, orphan := range orphans {
+				items = append(items, gcItem{Region: region, Orphan: orphan})
+			}
+
+			ddbClient, err := common.GetDynamoDBClientForRegion(region)
+			if err != nil {
+				fmt.Printf("Failed to get DynamoDB client for %s: %v\n", region, err)
+				return
+			}
+			exists, err := ddb.SearchDynamoDBLockTable(ddbClient)
+			if err != nil {
+				fmt.Printf("Failed to check lock table in %s: %v\n", region, err)
+				return
+			}
+			if !exists {
+				continue
+			}
+
+			lock := ddb.NewDynamoDBLock(ddbClient)
+			locks[region] = lock
+			expired, err := lock.ListExpiredItems(ctx)
+			if err != nil {
+				fmt.Printf("Failed to scan lock table in %s: %v\n", region, err)
+				return
+			}
+			for _, item := range expired {
+				items = append(items, gcItem{Region: region, Orphan: ec2utils.Orphan{
+					Kind:   gcLockItem,
+					ID:     item.LockID,
+					Detail: fmt.Sprintf("expired %s", item.Expires.Local().Format("2006-01-02 15:04:05")),
+				}})
+			}
+		}
+
+		if len(items) == 0 {
+			fmt.Println("Nothing to clean up.")
+			return
+		}
+
+		var total float64
+		fmt.Printf("\n%-15s %-15s %-40s %-12s %s\n", "KIND", "REGION", "ID", "EST. $/MONTH", "DETAIL")
+		for _, item := range items {
+			fmt.Printf("%-15s %-15s %-40s %-12s %s\n",
+				item.Orphan.Kind, item.Region, item.Orphan.ID, fmt.Sprintf("%.2f", item.Orphan.MonthlyCost), item.Orphan.Detail)
+			total += item.Orphan.MonthlyCost
+		}
+		fmt.Printf("\n%d item(s), about $%.2f per month\n", len(items), total)
+
+		if gcDryRunFlag {
+			fmt.Println("Dry run, nothing was deleted.")
+			return
+		}
+		if !gcYesFlag && !confirm("Delete these resources?") {
+			fmt.Println("Aborted.")
+			return
+		}
+
+		failed := 0
+		for _, item := range items {
+			var err error
+			if item.Orphan.Kind == gcLockItem {
+				err = locks[item.Region].DeleteExpiredItem(ctx, item.Orphan.ID)
+			} else {
+				err = ec2utils.DeleteOrphan(ctx, ec2Clients[item.Region], item.Orphan)
+			}
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				failed++
+				continue
+			}
+			fmt.Printf("Deleted %s [%s] in %s\n", item.Orphan.Kind, item.Orphan.ID, item.Region)
+		}
+		fmt.Printf("Removed %d of %d item(s).\n", len(items)-failed, len(items))
+	},
+}
+
+// managedRegions returns the configured region and every region a profile was migrated to
+func managedRegions(cfg *common.AWSConfig) []string {
+	seen := map[string]bool{cfg.Region: true}
+	regions := []string{cfg.Region}
+	for _, region := range cfg.ProfileRegions {
+		if !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions[1:])
+	return regions
+}
+
+// confirm asks a yes/no question on the terminal and defaults to no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	gcCmd.Flags().BoolVar(&gcDryRunFlag, "dry-run", false, "Only show what would be removed")
+	gcCmd.Flags().BoolVarP(&gcYesFlag, "yes", "y", false, "Do not ask for confirmation")
+	rootCmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+)
+
+// hostKeysTimeout bounds the wait for a new instance to print its host keys
+const hostKeysTimeout = 10 * time.Minute
+
+// knownHostsPath returns the known_hosts file holding the pinned host keys of a profile
+func knownHostsPath(profile string) string {
+	return filepath.Join(common.KnownHostsDir, profile)
+}
+
+// hostKeyAlias is the name the host keys of a profile are pinned under
+func hostKeyAlias(profile string) string {
+	return "dumie-" + profile
+}
+
+// errHostKeyMismatch stops the reconnects of a tunnel whose instance does not present the pinned host keys
+var errHostKeyMismatch = errors.New("SSH host keys do not match the pinned ones")
+
+// pinnedInstancePrefix starts the comment line recording the instance the keys were pinned from
+const pinnedInstancePrefix = "# instance "
+
+// pinHostKeys returns the known_hosts file of a profile, pinning the host keys the instance printed
+// to its console on first use. Restored instances keep their host keys, so the file stays valid
+// across archives. A key that differs from the pinned one is refused on the instance it was pinned
+// from; a later instance is re-pinned, as profiles archived before host keys were kept come back
+// with new ones and the console output comes from AWS rather than from the connection.
+func pinHostKeys(ctx context.Context, client *ec2.Client, profile, instanceID string) (string, error) {
+	path := knownHostsPath(profile)
+	pinned, pinnedInstance, err := readKnownHosts(path)
+	if err != nil {
+		return "", err
+	}
+
+	if len(pinned) > 0 {
+		console, err := ec2utils.GetConsoleOutput(ctx, client, instanceID)
+		if err != nil {
+			return "", err
+		}
+		// The console may not be published yet; ssh still checks the pinned keys
+		keys := ec2utils.ParseHostKeys(console)
+		if len(keys) == 0 {
+			return path, nil
+		}
+		matches := true
+		for _, key := range keys {
+			if !pinned[key] {
+				matches = false
+			}
+		}
+		if matches && pinnedInstance == instanceID {
+			return path, nil
+		}
+		if !matches {
+			if pinnedInstance == instanceID {
+				return "", fmt.Errorf("%w: instance [%s] of profile [%s] no longer presents the keys pinned in %s. "+
+					"Refusing to connect, as someone may be intercepting the connection. If the instance was rebuilt on purpose, "+
+					"remove %s and connect again", errHostKeyMismatch, instanceID, profile, path, path)
+			}
+			fmt.Printf("Instance [%s] of profile [%s] has new SSH host keys, re-pinning them from its console output\n", instanceID, profile)
+		}
+		return path, writeKnownHosts(path, profile, instanceID, keys)
+	}
+
+	keys, err := ec2utils.WaitForHostKeys(ctx, client, instanceID, hostKeysTimeout)
+	if err != nil {
+		return "", err
+	}
+	if err := writeKnownHosts(path, profile, instanceID, keys); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Pinned %d SSH host key(s) of instance [%s] for profile [%s] in %s\n", len(keys), instanceID, profile, path)
+	return path, nil
+}
+
+// writeKnownHosts pins the "type base64" host keys of an instance under the alias of its profile
+func writeKnownHosts(path, profile, instanceID string, keys []string) error {
+	var lines strings.Builder
+	fmt.Fprintf(&lines, "%s%s\n", pinnedInstancePrefix, instanceID)
+	for _, key := range keys {
+		fmt.Fprintf(&lines, "%s %s\n", hostKeyAlias(profile), key)
+	}
+	if err := os.MkdirAll(common.KnownHostsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", common.KnownHostsDir, err)
+	}
+	if err := os.WriteFile(path, []byte(lines.String()), 0600); err != nil {
+		return fmt.Errorf("failed to pin host keys of profile %s: %w", profile, err)
+	}
+	return nil
+}
+
+// readKnownHosts returns the "type base64" host keys in a known_hosts file and the instance they
+// were pinned from, or none if it does not exist. Files pinned before the instance was recorded
+// return an empty instance ID.
+func readKnownHosts(path string) (map[string]bool, string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read pinned host keys: %w", err)
+	}
+
+	keys := map[string]bool{}
+	instanceID := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, pinnedInstancePrefix) {
+			instanceID = strings.TrimSpace(strings.TrimPrefix(line, pinnedInstancePrefix))
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		keys[fields[1]+" "+fields[2]] = true
+	}
+	return keys, instanceID, nil
+}
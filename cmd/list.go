@@ -12,6 +12,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/spf13/cobra"
 )
 
@@ -21,31 +23,78 @@ type ProfileInfo struct {
 	Status     string
 	PublicIP   string
 	LaunchTime string
+	Pinned     string
+	Monitor    string
 }
 
 func printInstanceTable(profiles []ProfileInfo) {
-	fmt.Printf("\n%-20s %-25s %-15s %-18s %-20s\n",
-		"NAME", "INSTANCE ID", "STATE", "PUBLIC IP", "LAUNCH TIME")
-	fmt.Println(strings.Repeat("-", 105))
+	fmt.Printf("\n%-20s %-25s %-15s %-18s %-20s %-20s %-12s\n",
+		"NAME", "INSTANCE ID", "STATE", "PUBLIC IP", "LAUNCH TIME", "PINNED", "MONITOR")
+	fmt.Println(strings.Repeat("-", 138))
 
 	for _, p := range profiles {
-		fmt.Printf("%-20s %-25s %-20s %-18s %-20s\n",
+		fmt.Printf("%-20s %-25s %-15s %-18s %-20s %-20s %-12s\n",
 			p.Name,
 			p.InstanceID,
 			p.Status,
 			p.PublicIP,
 			p.LaunchTime,
+			p.Pinned,
+			p.Monitor,
 		)
 	}
 }
 
 var showAll bool
 
+// instanceProfileInfo fills a table row from an instance, naming it after its Name tag if it has one
+func instanceProfileInfo(inst types.Instance, name string) ProfileInfo {
+	for _, tag := range inst.Tags {
+		if aws.ToString(tag.Key) == "Name" {
+			name = aws.ToString(tag.Value)
+		}
+	}
+
+	publicIP := "-"
+	if inst.PublicIpAddress != nil {
+		publicIP = *inst.PublicIpAddress
+	}
+	launchTime := "-"
+	if inst.LaunchTime != nil {
+		launchTime = inst.LaunchTime.Local().Format("2006-01-02 15:04:05")
+	}
+
+	return ProfileInfo{
+		Name:       name,
+		InstanceID: aws.ToString(inst.InstanceId),
+		Status:     string(inst.State.Name),
+		PublicIP:   publicIP,
+		LaunchTime: launchTime,
+		Pinned:     ec2utils.GetPinInfo(inst.Tags).String(),
+		Monitor:    "-",
+	}
+}
+
+// listMonitorStatus condenses the agent heartbeat of a running profile into a table cell
+func listMonitorStatus(ctx context.Context, heartbeats *ddb.AgentStore, p ProfileInfo) string {
+	if heartbeats == nil {
+		return "unknown"
+	}
+	hb, err := heartbeats.GetHeartbeat(ctx, p.Name)
+	if err != nil {
+		return "unknown"
+	}
+	if hb == nil || hb.InstanceID != p.InstanceID || hb.Stale(time.Now()) {
+		return "not running"
+	}
+	return fmt.Sprintf("ok (idle %s)", (time.Duration(hb.IdleSeconds) * time.Second).String())
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all EC2 instances managed by Dumie",
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Second)
 		defer cancel()
 
 		client, err := common.GetEC2AWSClient()
@@ -54,7 +103,15 @@ var listCmd = &cobra.Command{
 			return
 		}
 
-		profileMap := map[string]ProfileInfo{}
+		// The registry names the profiles and their state; EC2 fills in the live instance details
+		var records []ddb.ProfileRecord
+		registry, err := newRegistry("")
+		if err == nil {
+			records, err = registry.List(ctx)
+		}
+		if err != nil {
+			fmt.Println("Warning: cannot read the profile registry:", err)
+		}
 
 		// collect instances with ManagedBy=Dumie
 		ec2Input := &ec2.DescribeInstancesInput{
@@ -71,90 +128,147 @@ var listCmd = &cobra.Command{
 			return
 		}
 
+		instances := map[string]types.Instance{}
+		var instanceIDs []string
 		for _, r := range ec2Output.Reservations {
 			for _, inst := range r.Instances {
-				var name, publicIP, launchTime string
-				name = "-"
-				publicIP = "-"
-
-				for _, tag := range inst.Tags {
-					if *tag.Key == "Name" {
-						name = *tag.Value
-					}
+				if inst.State.Name == types.InstanceStateNameTerminated {
+					continue
 				}
+				instances[*inst.InstanceId] = inst
+				instanceIDs = append(instanceIDs, *inst.InstanceId)
+			}
+		}
+
+		// list only covers the configured region, so read heartbeats from its table
+		heartbeats, err := newAgentStore("")
+		if err != nil {
+			fmt.Println("Warning: cannot read agent heartbeats:", err)
+		}
 
-				if inst.PublicIpAddress != nil {
-					publicIP = *inst.PublicIpAddress
+		var profiles []ProfileInfo
+		registered := map[string]bool{}
+		known := map[string]bool{}
+		for _, record := range records {
+			known[record.Profile] = true
+			inst, hasInstance := instances[record.InstanceID]
+			if hasInstance {
+				registered[record.InstanceID] = true
+			}
+			if !showAll && !record.State.Active() {
+				continue
+			}
+
+			p := ProfileInfo{
+				Name:       record.Profile,
+				InstanceID: "-",
+				Status:     string(record.State),
+				PublicIP:   "-",
+				LaunchTime: "-",
+				Pinned:     "-",
+				Monitor:    "-",
+			}
+			if hasInstance {
+				p = instanceProfileInfo(inst, record.Profile)
+				p.Status = string(record.State)
+				if inst.State.Name != types.InstanceStateNameRunning {
+					p.Status += fmt.Sprintf(" (ec2: %s)", inst.State.Name)
 				}
-				if inst.LaunchTime != nil {
-					launchTime = inst.LaunchTime.Local().Format("2006-01-02 15:04:05")
+				if inst.State.Name == types.InstanceStateNameRunning {
+					p.Monitor = listMonitorStatus(ctx, heartbeats, p)
 				}
+			}
+			profiles = append(profiles, p)
+		}
 
-				profileMap[name] = ProfileInfo{
-					Name:       name,
-					InstanceID: *inst.InstanceId,
-					Status:     string(inst.State.Name),
-					PublicIP:   publicIP,
-					LaunchTime: launchTime,
-				}
+		// Instances the registry does not know about, e.g. launched by an older version
+		unregistered := 0
+		for _, id := range instanceIDs {
+			if registered[id] {
+				continue
+			}
+			inst := instances[id]
+			if !showAll && inst.State.Name != types.InstanceStateNameRunning {
+				continue
+			}
+			p := instanceProfileInfo(inst, "-")
+			known[p.Name] = true
+			p.Status = fmt.Sprintf("%s (unregistered)", inst.State.Name)
+			if inst.State.Name == types.InstanceStateNameRunning {
+				p.Monitor = listMonitorStatus(ctx, heartbeats, p)
 			}
+			profiles = append(profiles, p)
+			unregistered++
 		}
 
-		// collect snapshots to find archived profiles
+		// Profiles archived before the registry existed only have snapshots
 		if showAll {
-			snapInput := &ec2.DescribeSnapshotsInput{
-				Filters: []types.Filter{
-					{
-						Name:   aws.String("tag:ManagedBy"),
-						Values: []string{"Dumie"},
-					},
-				},
-				OwnerIds: []string{"self"},
-			}
-			snapOutput, err := client.DescribeSnapshots(ctx, snapInput)
-			if err == nil {
-				for _, snap := range snapOutput.Snapshots {
-					var profile string
-					for _, tag := range snap.Tags {
-						if *tag.Key == "Name" {
-							profile = *tag.Value
-							break
-						}
-					}
-					if profile != "" {
-						if _, exists := profileMap[profile]; !exists {
-							profileMap[profile] = ProfileInfo{
-								Name:       profile,
-								InstanceID: "-",
-								Status:     "archived",
-								PublicIP:   "-",
-								LaunchTime: "-",
-							}
-						}
-					}
-				}
+			archived, err := unregisteredArchives(ctx, client, known)
+			if err != nil {
+				fmt.Println("Warning: cannot list snapshots:", err)
 			}
+			profiles = append(profiles, archived...)
+			unregistered += len(archived)
 		}
 
-		if len(profileMap) == 0 {
+		if len(profiles) == 0 {
 			fmt.Println("No profiles managed by Dumie found.")
 			return
 		}
 
-		var profiles []ProfileInfo
-		for _, p := range profileMap {
-			if !showAll && !strings.HasPrefix(p.Status, "running") {
+		printInstanceTable(profiles)
+		if unregistered > 0 {
+			fmt.Printf("\n%d profile(s) are missing from the profile registry. Run dumie reconcile to add them.\n", unregistered)
+		}
+	},
+}
+
+// unregisteredArchives returns a row for every profile with Dumie snapshots that is not in known
+func unregisteredArchives(ctx context.Context, client *ec2.Client, known map[string]bool) ([]ProfileInfo, error) {
+	paginator := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"Dumie"},
+			},
+		},
+		OwnerIds: []string{"self"},
+	})
+
+	var profiles []ProfileInfo
+	seen := map[string]bool{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return profiles, err
+		}
+		for _, snap := range page.Snapshots {
+			profile := ""
+			for _, tag := range snap.Tags {
+				if aws.ToString(tag.Key) == "Name" {
+					profile = aws.ToString(tag.Value)
+				}
+			}
+			if profile == "" || known[profile] || seen[profile] {
 				continue
 			}
-			profiles = append(profiles, p)
+			seen[profile] = true
+			profiles = append(profiles, ProfileInfo{
+				Name:       profile,
+				InstanceID: "-",
+				Status:     "archived (unregistered)",
+				PublicIP:   "-",
+				LaunchTime: "-",
+				Pinned:     "-",
+				Monitor:    "-",
+			})
 		}
-
-		printInstanceTable(profiles)
-	},
+	}
+	return profiles, nil
 }
 
 func init() {
 	rootCmd.AddCommand(listCmd)
-	listCmd.Flags().BoolVar(&showAll, "all", false, "Show all instances and snapshot-only profiles")
+	listCmd.Flags().BoolVar(&showAll, "all", false, "Show archived and failed profiles and stopped instances too")
 	flag.CommandLine.Parse([]string{}) // for compatibility with cobra+flag
 }
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	"github.com/spf13/cobra"
+)
+
+var lockBreakYesFlag bool
+
+// lockCmd groups the commands that inspect and clear profile locks
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect and clear profile locks",
+}
+
+// lockListCmd shows who holds the lock of each profile
+var lockListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List profile locks with their holder, operation and expiry",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+
+		fmt.Printf("%-20s %-15s %-15s %-20s %-45s\n", "PROFILE", "REGION", "OPERATION", "EXPIRES", "HOLDER")
+		for _, region := range managedRegions(cfg) {
+			ddbClient, err := common.GetDynamoDBClientForRegion(region)
+			if err != nil {
+				fmt.Printf("Failed to get DynamoDB client for %s: %v\n", region, err)
+				return
+			}
+			exists, err := ddb.SearchDynamoDBLockTable(ddbClient)
+			if err != nil {
+				fmt.Printf("Failed to check lock table in %s: %v\n", region, err)
+				return
+			}
+			if !exists {
+				continue
+			}
+
+			locks, err := ddb.NewDynamoDBLock(ddbClient).ListProfileLocks(ctx)
+			if err != nil {
+				fmt.Printf("Failed to list locks in %s: %v\n", region, err)
+				return
+			}
+			for _, info := range locks {
+				fmt.Printf("%-20s %-15s %-15s %-20s %-45s\n",
+					info.Profile, region, valueOrDash(info.Operation), lockExpiry(info), info.Owner)
+			}
+		}
+	},
+}
+
+// lockBreakCmd removes a stuck profile lock, e.g. one left by a process that was killed
+var lockBreakCmd = &cobra.Command{
+	Use:   "break [profile]",
+	Short: "Clear a stuck profile lock",
+	Long: `Clear the lock of a profile, e.g. one left by a process that was killed.
+Only break a lock whose holder is gone; a live holder notices on its next renewal and stops.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ddbClient, err := common.GetDynamoDBClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to get DynamoDB client: %v\n", err)
+			return
+		}
+		lock := ddb.NewDynamoDBLock(ddbClient)
+
+		info, err := lock.GetProfileLock(ctx, profile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if info == nil {
+			fmt.Printf("Profile [%s] is not locked\n", profile)
+			return
+		}
+
+		fmt.Printf("Profile [%s] is locked by %s\n", profile, info.Owner)
+		fmt.Printf("Operation: %s\n", valueOrDash(info.Operation))
+		fmt.Printf("Expires:   %s\n", lockExpiry(*info))
+		if !lockBreakYesFlag && !confirm("Break this lock?") {
+			fmt.Println("Aborted.")
+			return
+		}
+
+		if err := lock.BreakLock(ctx, info.LockID, info.Owner.Token); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Lock of profile [%s] broken.\n", profile)
+	},
+}
+
+// lockExpiry formats when a lock expires, marking locks that already have
+func lockExpiry(info ddb.LockInfo) string {
+	expires := info.Expires.Local().Format("2006-01-02 15:04:05")
+	if info.Expired() {
+		return fmt.Sprintf("%s (expired %s ago)", expires, time.Since(info.Expires).Round(time.Second))
+	}
+	return expires
+}
+
+// valueOrDash shows empty table cells as -
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	lockBreakCmd.Flags().BoolVarP(&lockBreakYesFlag, "yes", "y", false, "Do not ask for confirmation")
+	lockCmd.AddCommand(lockListCmd)
+	lockCmd.AddCommand(lockBreakCmd)
+	rootCmd.AddCommand(lockCmd)
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+// agentLogPath is where the user data template makes the agent write its log
+const agentLogPath = "/var/log/dumie-agent.log"
+
+var (
+	logsFollowFlag bool
+	logsLinesFlag  int
+)
+
+// lastLines returns at most n trailing lines of text
+func lastLines(text string, n int) []string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [profile]",
+	Short: "Show the console output and agent log of a profile's instance",
+	Long: `Show the EC2 console output of the profile's latest instance. For a running instance
+the agent log is tailed over SSH (use --follow to keep streaming it). For an archived profile the
+last agent log lines saved before termination are shown instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		instance, err := ec2utils.FindLatestInstance(ctx, ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+
+		if instance != nil {
+			instanceID := *instance.InstanceId
+			console, err := ec2utils.GetConsoleOutput(ctx, ec2Client, instanceID)
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			} else if console == "" {
+				fmt.Printf("No console output available yet for instance [%s]\n", instanceID)
+			} else {
+				fmt.Printf("=== Console output of instance [%s] (%s) ===\n", instanceID, instance.State.Name)
+				fmt.Println(strings.Join(lastLines(console, logsLinesFlag), "\n"))
+			}
+		}
+
+		if instance != nil && instance.State.Name == types.InstanceStateNameRunning {
+			if err := tailAgentLog(ctx, ec2Client, profile, instance); err != nil {
+				fmt.Printf("Failed to tail agent log: %v\n", err)
+			}
+			return
+		}
+
+		if logsFollowFlag {
+			fmt.Printf("Profile [%s] has no running instance to follow\n", profile)
+		}
+		printLastWords(ctx, profile)
+	},
+}
+
+func tailAgentLog(ctx context.Context, client *ec2.Client, profile string, instance *types.Instance) error {
+	if instance.PublicDnsName == nil || *instance.PublicDnsName == "" {
+		return fmt.Errorf("instance [%s] has no public DNS name", *instance.InstanceId)
+	}
+
+	tailArgs := []string{"sudo", "tail", "-n", strconv.Itoa(logsLinesFlag)}
+	if logsFollowFlag {
+		tailArgs = append(tailArgs, "-F")
+	}
+	tailArgs = append(tailArgs, agentLogPath)
+
+	if err := allowSSHFromHere(ctx, client, *instance.InstanceId); err != nil {
+		return err
+	}
+
+	target := sshTarget{Profile: profile, InstanceID: *instance.InstanceId, PublicDNS: *instance.PublicDnsName}
+	args, err := sshArgs(ctx, client, target, nil, tailArgs...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("=== Agent log of instance [%s] ===\n", *instance.InstanceId)
+	sshCmd := exec.CommandContext(ctx, "ssh", args...)
+	sshCmd.Stdin = os.Stdin
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+
+	// Ctrl-C is how a follow is stopped, so it is not a failure
+	if err := sshCmd.Run(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func printLastWords(ctx context.Context, profile string) {
+	store, err := newAgentStore(profile)
+	if err != nil {
+		fmt.Printf("Failed to read last words: %v\n", err)
+		return
+	}
+
+	lw, err := store.GetLastWords(ctx, profile)
+	if err != nil {
+		fmt.Printf("Failed to read last words: %v\n", err)
+		return
+	}
+	if lw == nil {
+		fmt.Printf("No saved agent log found for profile [%s]\n", profile)
+		return
+	}
+
+	fmt.Printf("=== Last agent log lines of instance [%s] (saved %s) ===\n",
+		lw.InstanceID, lw.WrittenAt.Local().Format("2006-01-02 15:04:05"))
+	for _, line := range lw.Lines {
+		fmt.Println(line)
+	}
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsFollowFlag, "follow", "f", false, "Keep streaming the agent log of a running instance")
+	logsCmd.Flags().IntVarP(&logsLinesFlag, "lines", "n", 100, "Number of trailing lines to show")
+	rootCmd.AddCommand(logsCmd)
+}
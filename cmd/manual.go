@@ -7,6 +7,8 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
 	"github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/spf13/cobra"
 )
@@ -17,19 +19,52 @@ var manualCmd = &cobra.Command{
 	Long:  `TODO`,
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := args[0]
-		ctx := context.TODO()
+		ctx := cmd.Context()
 
-		instanceID, err := ec2.RestoreOrCreateInstance(ctx, profile, nil, nil, 60) // Default 60 seconds timeout
+		ctx, release, err := acquireProfileLock(ctx, profile, "deploy manual")
 		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		// A running instance keeps its record, so it is reported before anything is recorded
+		existing, err := ec2.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance: %v\n", err)
+			return
+		}
+		if existing != nil {
+			fmt.Printf("Instance [%s] already exists for profile [%s]\n", *existing, profile)
+			return
+		}
+
+		registry, err := newRegistry(profile)
+		if err != nil {
+			fmt.Printf("Warning: cannot record profile state: %v\n", err)
+		}
+
+		policy := ec2.Policy{TimeoutSeconds: ec2.DefaultTimeoutSeconds}
+		recordState(ctx, registry, profile, ddb.StateCreating, ddb.RecordUpdate{Spec: policy.Spec()})
+		instanceID, err := ec2.RestoreOrCreateInstance(ctx, profile, nil, nil, policy)
+		if err != nil {
+			recordState(context.WithoutCancel(ctx), registry, profile, ddb.StateFailed, ddb.RecordUpdate{Error: err.Error()})
 			fmt.Printf("Failed to create/restore instance: %v\n", err)
 			return
 		}
+		recordState(ctx, registry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: instanceID})
 
 		fmt.Printf("Instance [%s] launched successfully for profile [%s]\n", instanceID, profile)
 
-		err = ec2.DeleteOldSnapshotsByProfile(ctx, profile)
+		err = ec2.PruneProfileSnapshots(ctx, ec2Client, profile)
 		if err != nil {
-			fmt.Println("Warning: failed to delete old snapshots:", err)
+			fmt.Println("Warning: failed to prune old snapshots:", err)
 		}
 	},
 }
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/iam"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateToRegionFlag   string
+	migrateKeepSourceFlag bool
+	migrateKMSKeyFlag     string
+)
+
+// migrateCmd moves a profile to another region through a copy of its latest snapshot
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [profile]",
+	Short: "Move a profile to another AWS region",
+	Long: `Move a profile to another AWS region.
+A running instance is archived first. The latest snapshot is then copied to the target region,
+where the key pair, security group and lock table are set up if missing. The source instance
+and snapshots are only cleaned up after the copy has completed; use --keep-source to keep the
+source snapshots. The next dumie use restores the profile in the target region.
+
+KMS keys are regional, so an encrypted profile is copied with the default EBS key of the target
+region unless --kms-key names a key there.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+		sourceRegion := cfg.RegionFor(profile)
+		targetRegion := migrateToRegionFlag
+		if targetRegion == sourceRegion {
+			fmt.Printf("Profile [%s] already lives in %s\n", profile, targetRegion)
+			return
+		}
+
+		if migrateKMSKeyFlag != "" {
+			encryption, err := ec2utils.ParseEncryption(migrateKMSKeyFlag)
+			if err != nil || encryption.KMSKeyID() == "" {
+				fmt.Printf("Invalid --kms-key %q (expected a KMS key ID, alias or ARN in %s)\n", migrateKMSKeyFlag, targetRegion)
+				return
+			}
+		}
+
+		// Hold the profile lock in both regions for the whole migration
+		sourceDDB, err := common.GetDynamoDBClientForRegion(sourceRegion)
+		if err != nil {
+			fmt.Printf("Failed to get DynamoDB client for %s: %v\n", sourceRegion, err)
+			return
+		}
+		ctx, releaseSource, err := acquireProfileLockWith(ctx, sourceDDB, profile, "migrate")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer releaseSource()
+
+		targetDDB, err := common.GetDynamoDBClientForRegion(targetRegion)
+		if err != nil {
+			fmt.Printf("Failed to get DynamoDB client for %s: %v\n", targetRegion, err)
+			return
+		}
+		ctx, releaseTarget, err := acquireProfileLockWith(ctx, targetDDB, profile, "migrate")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer releaseTarget()
+
+		sourceEC2, err := common.GetEC2ClientForRegion(sourceRegion)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client for %s: %v\n", sourceRegion, err)
+			return
+		}
+		targetEC2, err := common.GetEC2ClientForRegion(targetRegion)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client for %s: %v\n", targetRegion, err)
+			return
+		}
+
+		existing, err := ec2utils.SearchEC2Instance(targetEC2, profile)
+		if err != nil {
+			fmt.Printf("Failed to check %s for an instance of profile [%s]: %v\n", targetRegion, profile, err)
+			return
+		}
+		if existing != nil {
+			fmt.Printf("Profile [%s] already has an instance [%s] in %s\n", profile, *existing, targetRegion)
+			return
+		}
+
+		// Archive the running instance so the copy includes its latest state
+		instanceIDPtr, err := ec2utils.SearchEC2Instance(sourceEC2, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		sourceRegistry := ddb.NewRegistry(sourceDDB)
+		if instanceIDPtr != nil {
+			recordState(ctx, sourceRegistry, profile, ddb.StateArchiving, ddb.RecordUpdate{InstanceID: *instanceIDPtr})
+			fmt.Printf("Archiving instance [%s] (profile: %s) before migration...\n", *instanceIDPtr, profile)
+			snapshotID, err := ec2utils.Archive(ctx, sourceEC2, ec2utils.ArchiveOptions{
+				Profile:    profile,
+				InstanceID: *instanceIDPtr,
+				Source:     ec2utils.ArchiveSourceCLI,
+				Reason:     fmt.Sprintf("migrating to %s", targetRegion),
+				Logger:     warnings,
+			})
+			if err != nil {
+				recordState(context.WithoutCancel(ctx), sourceRegistry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: *instanceIDPtr, Error: err.Error()})
+				fmt.Printf("Archive of instance [%s] failed, nothing was migrated: %v\n", *instanceIDPtr, err)
+				return
+			}
+			// The instance is kept until the copy has completed, so a failed copy leaves it running
+			recordState(ctx, sourceRegistry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: *instanceIDPtr, SnapshotID: snapshotID})
+		}
+
+		snapshot, err := ec2utils.LatestSnapshot(ctx, sourceEC2, profile)
+		if err != nil {
+			fmt.Printf("Failed to find snapshots for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if snapshot == nil {
+			fmt.Printf("Profile [%s] has no snapshot in %s to migrate\n", profile, sourceRegion)
+			return
+		}
+
+		// Make sure the target region can launch the profile
+		fmt.Printf("Preparing %s for profile [%s]...\n", targetRegion, profile)
+		if err := common.EnsureKeyPairInRegion(ctx, targetEC2, cfg.KeyPairName); err != nil {
+			fmt.Printf("Failed to set up key pair in %s: %v\n", targetRegion, err)
+			return
+		}
+		if _, err := ec2utils.CreateOrGetProfileSecurityGroup(ctx, targetEC2, profile); err != nil {
+			fmt.Printf("Failed to set up security group in %s: %v\n", targetRegion, err)
+			return
+		}
+		iamClient, err := common.GetIAMClient()
+		if err != nil {
+			fmt.Printf("Failed to get IAM client: %v\n", err)
+			return
+		}
+		if _, err := iam.GetInstanceManagerRoleARN(iamClient); err != nil {
+			if err := iam.CreateInstanceManagerRole(iamClient, cfg.LockTableName()); err != nil {
+				fmt.Printf("Failed to set up IAM role: %v\n", err)
+				return
+			}
+		}
+
+		fmt.Printf("Copying snapshot [%s] from %s to %s...\n", *snapshot.SnapshotId, sourceRegion, targetRegion)
+		copyID, err := ec2utils.CopySnapshotToRegion(ctx, targetEC2, sourceRegion, profile, *snapshot, migrateKMSKeyFlag)
+		if err != nil {
+			fmt.Printf("Failed to copy snapshot, the profile stays in %s: %v\n", sourceRegion, err)
+			return
+		}
+		fmt.Printf("Snapshot [%s] copied to %s as [%s]\n", *snapshot.SnapshotId, targetRegion, copyID)
+
+		if cfg.ProfileRegions == nil {
+			cfg.ProfileRegions = map[string]string{}
+		}
+		if targetRegion == cfg.Region {
+			delete(cfg.ProfileRegions, profile)
+		} else {
+			cfg.ProfileRegions[profile] = targetRegion
+		}
+		if err := common.SaveAWSConfig(cfg); err != nil {
+			fmt.Printf("Failed to record the new region of profile [%s]: %v\n", profile, err)
+			return
+		}
+
+		// The copy is complete, so the source can be cleaned up
+		if instanceIDPtr != nil {
+			if err := ec2utils.TerminateInstance(ctx, sourceEC2, *instanceIDPtr); err != nil {
+				fmt.Printf("Warning: failed to terminate source instance [%s]: %v\n", *instanceIDPtr, err)
+			}
+		}
+		if !migrateKeepSourceFlag {
+			if err := ec2utils.DeleteProfileSnapshots(ctx, sourceEC2, profile); err != nil {
+				fmt.Printf("Warning: failed to delete source snapshots: %v\n", err)
+			}
+		}
+
+		// Reconcile only looks at the region a profile lives in, so move its record along with it
+		recordMigration(ctx, sourceRegistry, ddb.NewRegistry(targetDDB), targetEC2, profile)
+
+		fmt.Printf("Profile [%s] migrated from %s to %s. Run dumie use %s to start it there.\n", profile, sourceRegion, targetRegion, profile)
+	},
+}
+
+// recordMigration removes the registry record of a migrated profile from its source region and
+// records it as archived in the target region with the spec of the copied snapshot
+func recordMigration(ctx context.Context, source, target *ddb.Registry, targetEC2 *ec2.Client, profile string) {
+	if err := source.Delete(ctx, profile); err != nil {
+		fmt.Printf("Warning: failed to remove profile [%s] from the source registry: %v\n", profile, err)
+	}
+
+	snapshot, err := ec2utils.LatestSnapshot(ctx, targetEC2, profile)
+	if err != nil {
+		fmt.Printf("Warning: failed to find the migrated snapshot of profile [%s]: %v (run dumie reconcile to repair)\n", profile, err)
+		return
+	}
+	if snapshot == nil {
+		fmt.Printf("Warning: no migrated snapshot of profile [%s] to record (run dumie reconcile to repair)\n", profile)
+		return
+	}
+	recordState(ctx, target, profile, ddb.StateArchived, ddb.RecordUpdate{
+		SnapshotID: aws.ToString(snapshot.SnapshotId),
+		Spec:       ec2utils.GetPolicy(snapshot.Tags).Spec(),
+	})
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateToRegionFlag, "to-region", "", "Region to move the profile to (e.g. eu-west-1)")
+	migrateCmd.MarkFlagRequired("to-region")
+	migrateCmd.Flags().BoolVar(&migrateKeepSourceFlag, "keep-source", false, "Keep the snapshots in the source region")
+	migrateCmd.Flags().StringVar(&migrateKMSKeyFlag, "kms-key", "", "KMS key in the target region to encrypt the copy with (default: the region's default EBS key)")
+	rootCmd.AddCommand(migrateCmd)
+}
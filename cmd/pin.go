@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pinForFlag   time.Duration
+	pinUntilFlag string
+)
+
+// pinCmd keeps a profile's instance alive by telling the on-instance monitor not to archive it
+var pinCmd = &cobra.Command{
+	Use:   "pin [profile]",
+	Short: "Keep a profile's instance alive so it is never auto-archived",
+	Long: `Pin the running instance of a profile so that the SSH monitor never archives it,
+even when no SSH sessions are active. The pin can optionally expire with --for or --until.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		var until *time.Time
+		if cmd.Flags().Changed("for") && cmd.Flags().Changed("until") {
+			fmt.Println("Only one of --for and --until can be given")
+			return
+		}
+		if cmd.Flags().Changed("for") {
+			t := time.Now().Add(pinForFlag)
+			until = &t
+		}
+		if cmd.Flags().Changed("until") {
+			t, err := time.Parse(time.RFC3339, pinUntilFlag)
+			if err != nil {
+				fmt.Printf("Invalid --until value %q (expected RFC 3339, e.g. 2025-01-02T08:00:00Z): %v\n", pinUntilFlag, err)
+				return
+			}
+			until = &t
+		}
+		if until != nil && !until.After(time.Now()) {
+			fmt.Println("Pin expiry must be in the future")
+			return
+		}
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		instanceIDPtr, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if instanceIDPtr == nil {
+			fmt.Printf("No running instance found for profile [%s]\n", profile)
+			return
+		}
+		instanceID := *instanceIDPtr
+
+		if err := ec2utils.PinInstance(ctx, ec2Client, instanceID, until); err != nil {
+			fmt.Printf("Failed to pin profile [%s]: %v\n", profile, err)
+			return
+		}
+
+		if until != nil {
+			fmt.Printf("Instance [%s] (profile: %s) pinned until %s\n", instanceID, profile, until.Local().Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Printf("Instance [%s] (profile: %s) pinned until unpinned\n", instanceID, profile)
+		}
+	},
+}
+
+// unpinCmd lets the on-instance monitor archive a previously pinned profile again
+var unpinCmd = &cobra.Command{
+	Use:   "unpin [profile]",
+	Short: "Allow a pinned profile's instance to be auto-archived again",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		instanceIDPtr, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if instanceIDPtr == nil {
+			fmt.Printf("No running instance found for profile [%s]\n", profile)
+			return
+		}
+		instanceID := *instanceIDPtr
+
+		if err := ec2utils.UnpinInstance(ctx, ec2Client, instanceID); err != nil {
+			fmt.Printf("Failed to unpin profile [%s]: %v\n", profile, err)
+			return
+		}
+
+		fmt.Printf("Instance [%s] (profile: %s) unpinned\n", instanceID, profile)
+	},
+}
+
+func init() {
+	pinCmd.Flags().DurationVar(&pinForFlag, "for", 0, "Expire the pin after this duration (e.g. 12h)")
+	pinCmd.Flags().StringVar(&pinUntilFlag, "until", "", "Expire the pin at this RFC 3339 time (e.g. 2025-01-02T08:00:00Z)")
+	rootCmd.AddCommand(pinCmd)
+	rootCmd.AddCommand(unpinCmd)
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var portsCIDRFlag string
+
+// portsCmd groups the commands that manage the ports opened on the security group of a profile
+var portsCmd = &cobra.Command{
+	Use:   "ports",
+	Short: "List, open and close the ports of a profile",
+	Long: `Manage the ports opened on the security group of a profile. Every profile has its own
+security group, so opening a port for one profile leaves the others closed. The ports are kept
+with the profile and opened again when it is restored from a snapshot.`,
+}
+
+var portsListCmd = &cobra.Command{
+	Use:   "list [profile]",
+	Short: "List the ports opened for a profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		_, rules, err := profilePorts(ctx, ec2Client, profile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(rules) == 0 {
+			fmt.Printf("No ports opened for profile [%s]\n", profile)
+			return
+		}
+
+		fmt.Printf("\n%-8s %-8s %s\n", "PORT", "PROTO", "CIDR")
+		for _, rule := range rules {
+			fmt.Printf("%-8d %-8s %s\n", rule.Port, rule.Protocol, rule.CIDR)
+		}
+	},
+}
+
+var portsOpenCmd = &cobra.Command{
+	Use:   "open [profile] [port[/proto]]",
+	Short: "Open a port of a profile",
+	Long: `Open a tcp or udp port on the security group of a profile. The port is reachable from
+the CIDR block given with --cidr, or from the public IP of this machine if it is not given.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		changePorts(cmd, args[0], args[1], true)
+	},
+}
+
+var portsCloseCmd = &cobra.Command{
+	Use:   "close [profile] [port[/proto]]",
+	Short: "Close a port of a profile",
+	Long: `Close a tcp or udp port on the security group of a profile. Without --cidr the port is
+closed for every CIDR block it was opened for.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		changePorts(cmd, args[0], args[1], false)
+	},
+}
+
+// changePorts opens or closes a port of a profile and records the result wherever the ports of the
+// profile are kept: the instance or latest archive tags, the security group and the registry spec
+func changePorts(cmd *cobra.Command, profile, portArg string, open bool) {
+	ctx := cmd.Context()
+
+	port, protocol, err := ec2utils.ParsePort(portArg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	operation := "ports close"
+	if open {
+		operation = "ports open"
+	}
+	ctx, release, err := acquireProfileLock(ctx, profile, operation)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer release()
+
+	ec2Client, err := common.GetEC2ClientForProfile(profile)
+	if err != nil {
+		fmt.Printf("Failed to create EC2 client: %v\n", err)
+		return
+	}
+
+	cidr := ""
+	if cmd.Flags().Changed("cidr") {
+		cidr, err = common.ParseCIDR(portsCIDRFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if open {
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+		cidr, err = common.CallerCIDR(ctx, cfg)
+		if err != nil {
+			fmt.Printf("Failed to detect the public IP of this machine, pass --cidr: %v\n", err)
+			return
+		}
+	}
+
+	instanceID, rules, err := profilePorts(ctx, ec2Client, profile)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var updated []ec2utils.PortRule
+	changed := false
+	for _, rule := range rules {
+		if !open && rule.Port == port && rule.Protocol == protocol && (cidr == "" || rule.CIDR == cidr) {
+			changed = true
+			continue
+		}
+		updated = append(updated, rule)
+	}
+	if open {
+		rule := ec2utils.PortRule{Port: port, Protocol: protocol, CIDR: cidr}
+		changed = true
+		for _, existing := range updated {
+			if existing == rule {
+				changed = false
+			}
+		}
+		if changed {
+			updated = append(updated, rule)
+		}
+	}
+	if !changed {
+		if open {
+			fmt.Printf("Port %d/%s of profile [%s] is already open to %s\n", port, protocol, profile, cidr)
+		} else {
+			fmt.Printf("Port %d/%s of profile [%s] is not open\n", port, protocol, profile)
+		}
+		return
+	}
+	ec2utils.SortPortRules(updated)
+
+	if err := ec2utils.SetProfilePorts(ctx, ec2Client, profile, instanceID, updated); err != nil {
+		fmt.Printf("Failed to record the ports of profile [%s]: %v\n", profile, err)
+		return
+	}
+
+	// An archived profile gets its ports when it is restored, but keep an existing group in sync
+	groupID := ""
+	if instanceID != "" {
+		groupID, err = ec2utils.CreateOrGetProfileSecurityGroup(ctx, ec2Client, profile)
+		if err == nil {
+			// Instances launched before profiles had their own group only have the shared one
+			err = ec2utils.AttachSecurityGroup(ctx, ec2Client, instanceID, groupID)
+		}
+	} else {
+		groupID, err = ec2utils.GetProfileSecurityGroup(ctx, ec2Client, profile)
+	}
+	if err == nil && groupID != "" {
+		err = ec2utils.ApplyPortRules(ctx, ec2Client, groupID, updated)
+	}
+	if err != nil {
+		fmt.Printf("Failed to update the security group of profile [%s]: %v\n", profile, err)
+		return
+	}
+
+	recordPorts(ctx, profile, updated)
+
+	if open {
+		fmt.Printf("Port %d/%s of profile [%s] opened to %s\n", port, protocol, profile, cidr)
+	} else {
+		fmt.Printf("Port %d/%s of profile [%s] closed\n", port, protocol, profile)
+	}
+}
+
+// profilePorts returns the instance of a profile, if it has one, and the ports recorded on the
+// instance or, for an archived profile, on its latest snapshot
+func profilePorts(ctx context.Context, client *ec2.Client, profile string) (string, []ec2utils.PortRule, error) {
+	instanceIDPtr, err := ec2utils.SearchEC2Instance(client, profile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find instance for profile [%s]: %w", profile, err)
+	}
+	if instanceIDPtr != nil {
+		output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{*instanceIDPtr}})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to describe instance [%s]: %w", *instanceIDPtr, err)
+		}
+		if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+			return "", nil, fmt.Errorf("instance [%s] not found", *instanceIDPtr)
+		}
+		return *instanceIDPtr, ec2utils.GetPolicy(output.Reservations[0].Instances[0].Tags).Ports, nil
+	}
+
+	snapshot, err := ec2utils.LatestSnapshot(ctx, client, profile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find snapshots for profile [%s]: %w", profile, err)
+	}
+	if snapshot == nil {
+		return "", nil, fmt.Errorf("profile [%s] has no instance or snapshot", profile)
+	}
+	return "", ec2utils.GetPolicy(snapshot.Tags).Ports, nil
+}
+
+// recordPorts writes the ports of a profile to its spec in the registry
+func recordPorts(ctx context.Context, profile string, rules []ec2utils.PortRule) {
+	registry, err := newRegistry(profile)
+	if err != nil {
+		fmt.Printf("Warning: cannot record profile state: %v\n", err)
+		return
+	}
+	record, err := registry.Get(ctx, profile)
+	if err != nil {
+		fmt.Printf("Warning: %v (run dumie reconcile to repair)\n", err)
+		return
+	}
+	if record == nil {
+		return
+	}
+
+	spec := map[string]string{}
+	for key, value := range record.Spec {
+		spec[key] = value
+	}
+	delete(spec, ec2utils.PortsTag)
+	if len(rules) > 0 {
+		spec[ec2utils.PortsTag] = ec2utils.FormatPortRules(rules)
+	}
+	recordState(ctx, registry, profile, record.State, ddb.RecordUpdate{
+		InstanceID: record.InstanceID,
+		SnapshotID: record.SnapshotID,
+		Spec:       spec,
+		Error:      record.Error,
+	})
+}
+
+func init() {
+	portsOpenCmd.Flags().StringVar(&portsCIDRFlag, "cidr", "", "CIDR block or IP the port is opened to (default: the public IP of this machine)")
+	portsCloseCmd.Flags().StringVar(&portsCIDRFlag, "cidr", "", "CIDR block or IP the port is closed for (default: all)")
+
+	portsCmd.AddCommand(portsListCmd)
+	portsCmd.AddCommand(portsOpenCmd)
+	portsCmd.AddCommand(portsCloseCmd)
+	rootCmd.AddCommand(portsCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+)
+
+// acquireProfileLock takes the lock of a profile in the region it lives in, waiting up to
+// --lock-timeout for another holder and creating the lock table if needed. The operation is shown to anyone waiting for the lock.
+// The returned context is canceled if the lock is lost, so the guarded work must run under it; the
+// returned function releases the lock.
+func acquireProfileLock(ctx context.Context, profile, operation string) (context.Context, func(), error) {
+	ddbClient, err := common.GetDynamoDBClientForProfile(profile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get DynamoDB client: %w", err)
+	}
+
+	return acquireProfileLockWith(ctx, ddbClient, profile, operation)
+}
+
+// acquireProfileLockWith takes the lock of a profile in the lock table the client points to
+// and keeps it alive until the returned function releases it
+func acquireProfileLockWith(ctx context.Context, ddbClient *dynamodb.Client, profile, operation string) (context.Context, func(), error) {
+	lock := ddb.NewDynamoDBLock(ddbClient)
+	lock.Operation = operation
+
+	exists, err := ddb.SearchDynamoDBLockTable(ddbClient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check lock table: %w", err)
+	}
+	if !exists {
+		if err := lock.CreateLockTable(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to create lock table: %w", err)
+		}
+	}
+
+	lockID := ddb.ProfileLockID(profile)
+	err = lock.WaitForLock(ctx, lockID, lockTimeoutFlag, func(held *ddb.ErrLockHeld, elapsed time.Duration) {
+		fmt.Printf("Waiting for profile [%s]: %v (elapsed: %v)\n", profile, held, elapsed.Round(time.Second))
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("profile [%s] is busy, try again later: %w", profile, err)
+	}
+
+	lease := lock.KeepAlive(ctx, lockID)
+	return lease.Context(), func() {
+		if err := lease.Stop(); err != nil {
+			fmt.Printf("Warning: the lock for profile [%s] was lost during the operation: %v\n", profile, err)
+			return
+		}
+		// Release even when the command was interrupted
+		if err := lock.ReleaseLock(context.WithoutCancel(ctx), lockID); err != nil {
+			fmt.Printf("Warning: failed to release lock for profile [%s]: %v\n", profile, err)
+		}
+	}, nil
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var reconcileDryRunFlag bool
+
+// reconcileCmd repairs the profile registry from the instances and snapshots in EC2
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Repair the profile registry from AWS",
+	Long: `Compare the profile registry with the instances and snapshots in every region Dumie manages
+profiles in, and fix the records that disagree. A profile with an instance is running, a profile
+with only snapshots is archived and a record without either is removed. Profiles whose lock is
+held are skipped, as their state is changing.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+
+		fixed := 0
+		for _, region := range managedRegions(cfg) {
+			ddbClient, err := common.GetDynamoDBClientForRegion(region)
+			if err != nil {
+				fmt.Printf("Failed to get DynamoDB client for %s: %v\n", region, err)
+				return
+			}
+			exists, err := ddb.SearchDynamoDBLockTable(ddbClient)
+			if err != nil {
+				fmt.Printf("Failed to check lock table in %s: %v\n", region, err)
+				return
+			}
+			if !exists {
+				continue
+			}
+
+			ec2Client, err := common.GetEC2ClientForRegion(region)
+			if err != nil {
+				fmt.Printf("Failed to create EC2 client for %s: %v\n", region, err)
+				return
+			}
+			inventory, err := ec2utils.TakeInventory(ctx, ec2Client)
+			if err != nil {
+				fmt.Printf("Failed to scan %s: %v\n", region, err)
+				return
+			}
+
+			registry := ddb.NewRegistry(ddbClient)
+			records, err := registry.List(ctx)
+			if err != nil {
+				fmt.Printf("Failed to read the profile registry in %s: %v\n", region, err)
+				return
+			}
+			recorded := map[string]ddb.ProfileRecord{}
+			for _, record := range records {
+				recorded[record.Profile] = record
+			}
+
+			profiles := inventory.Profiles()
+			for profile := range recorded {
+				if _, ok := inventory.Instances[profile]; !ok {
+					if _, ok := inventory.Snapshots[profile]; !ok {
+						profiles = append(profiles, profile)
+					}
+				}
+			}
+			sort.Strings(profiles)
+
+			lock := ddb.NewDynamoDBLock(ddbClient)
+			for _, profile := range profiles {
+				// Snapshots left behind by a migration belong to the profile's new region
+				if cfg.RegionFor(profile) != region {
+					continue
+				}
+
+				var current *ddb.ProfileRecord
+				if record, ok := recorded[profile]; ok {
+					current = &record
+				}
+				want := desiredRecord(profile, current, inventory)
+				if sameRecord(current, want) {
+					continue
+				}
+
+				held, err := lock.GetProfileLock(ctx, profile)
+				if err != nil {
+					fmt.Printf("Warning: %v\n", err)
+					continue
+				}
+				if held != nil && !held.Expired() {
+					fmt.Printf("%-20s %-15s skipped, locked by %s\n", profile, region, held.Owner)
+					continue
+				}
+
+				fmt.Printf("%-20s %-15s %s -> %s\n", profile, region, describeRecord(current), describeRecord(want))
+				fixed++
+				if reconcileDryRunFlag {
+					continue
+				}
+
+				if want == nil {
+					err = registry.Delete(ctx, profile)
+				} else {
+					err = registry.Put(ctx, *want)
+				}
+				if err != nil {
+					fmt.Printf("Warning: %v\n", err)
+				}
+			}
+		}
+
+		switch {
+		case fixed == 0:
+			fmt.Println("The profile registry matches AWS.")
+		case reconcileDryRunFlag:
+			fmt.Printf("%d record(s) disagree with AWS. Dry run, nothing was changed.\n", fixed)
+		default:
+			fmt.Printf("Repaired %d record(s).\n", fixed)
+		}
+	},
+}
+
+// desiredRecord returns the record a profile should have given what EC2 holds, or nil if the
+// profile has neither an instance nor a snapshot
+func desiredRecord(profile string, current *ddb.ProfileRecord, inventory *ec2utils.Inventory) *ddb.ProfileRecord {
+	now := time.Now()
+	want := ddb.ProfileRecord{
+		Profile:   profile,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if current != nil {
+		want.CreatedAt = current.CreatedAt
+		want.SnapshotID = current.SnapshotID
+		want.Spec = current.Spec
+	}
+	if snapshot, ok := inventory.Snapshots[profile]; ok {
+		want.SnapshotID = aws.ToString(snapshot.SnapshotId)
+		if current == nil {
+			want.CreatedAt = aws.ToTime(snapshot.StartTime)
+		}
+	}
+
+	if instance, ok := inventory.Instances[profile]; ok {
+		want.State = ddb.StateRunning
+		want.InstanceID = aws.ToString(instance.InstanceId)
+		want.Spec = ec2utils.GetPolicy(instance.Tags).Spec()
+		if current == nil {
+			want.CreatedAt = aws.ToTime(instance.LaunchTime)
+		}
+		return &want
+	}
+	if _, ok := inventory.Snapshots[profile]; ok {
+		want.State = ddb.StateArchived
+		return &want
+	}
+	return nil
+}
+
+// sameRecord reports whether the registry already has what reconcile would write
+func sameRecord(current, want *ddb.ProfileRecord) bool {
+	if current == nil || want == nil {
+		return current == nil && want == nil
+	}
+	if current.State != want.State || current.InstanceID != want.InstanceID {
+		return false
+	}
+	return want.State != ddb.StateArchived || current.SnapshotID == want.SnapshotID
+}
+
+// describeRecord summarizes a record for the reconcile report
+func describeRecord(record *ddb.ProfileRecord) string {
+	switch {
+	case record == nil:
+		return "(none)"
+	case record.InstanceID != "":
+		return fmt.Sprintf("%s [%s]", record.State, record.InstanceID)
+	case record.SnapshotID != "":
+		return fmt.Sprintf("%s [%s]", record.State, record.SnapshotID)
+	default:
+		return string(record.State)
+	}
+}
+
+func init() {
+	reconcileCmd.Flags().BoolVar(&reconcileDryRunFlag, "dry-run", false, "Only show the records that disagree with AWS")
+	rootCmd.AddCommand(reconcileCmd)
+}
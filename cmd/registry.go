@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+)
+
+// newRegistry returns the profile registry in the region a profile lives in
+func newRegistry(profile string) (*ddb.Registry, error) {
+	ddbClient, err := common.GetDynamoDBClientForProfile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DynamoDB client: %w", err)
+	}
+	return ddb.NewRegistry(ddbClient), nil
+}
+
+// recordState moves a profile to a new state in the registry. The registry only mirrors what
+// happened in AWS, so a failure is reported without failing the command; dumie reconcile repairs it.
+func recordState(ctx context.Context, registry *ddb.Registry, profile string, to ddb.ProfileState, update ddb.RecordUpdate) {
+	if registry == nil {
+		return
+	}
+	if err := registry.Transition(ctx, profile, to, update); err != nil {
+		fmt.Printf("Warning: failed to record profile state: %v (run dumie reconcile to repair)\n", err)
+	}
+}
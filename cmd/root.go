@@ -4,15 +4,22 @@ Copyright © 2025 Chanhyeok Seo chanhyeok.seo2@gmail.com
 package cmd
 
 import (
+	"context"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/dumie-org/dumie-cli/internal/version"
 	"github.com/spf13/cobra"
 )
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "dumie",
-	Short: "Dumie, a smart on-demand instance manager",
+	Use:     "dumie",
+	Version: version.Version,
+	Short:   "Dumie, a smart on-demand instance manager",
 	Long: `Dumie is a CLI tool designed to help you easily manage dummy instances used for testing purposes. 
 It provides an automated and simple command-line interface that helps reduce cloud costs in testing environments. 
 By tracking the active status of instances, it automatically terminates them to save costs and automatically saves the work state of testing environments.
@@ -25,10 +32,24 @@ Dumie has four types of managers:
 `,
 }
 
+// lockTimeoutFlag is how long commands wait for a profile lock held by someone else
+var lockTimeoutFlag time.Duration
+
+// warnings prints the warnings of library calls that do not fail a command
+var warnings = log.New(os.Stdout, "Warning: ", 0)
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Commands get a context that is canceled on Ctrl-C or SIGTERM; a second signal kills the process.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
 	if err != nil {
 		os.Exit(1)
 	}
@@ -40,6 +61,7 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cobra.yaml)")
+	rootCmd.PersistentFlags().DurationVar(&lockTimeoutFlag, "lock-timeout", 10*time.Minute, "How long to wait for a profile lock held by another process (0 fails at once)")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
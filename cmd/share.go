@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/spf13/cobra"
+)
+
+var (
+	shareAccountFlag string
+	shareKMSKeyFlag  string
+	importAsFlag     string
+	importRegionFlag string
+	importKMSKeyFlag string
+	accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+	// kmsKeyARNPattern matches a KMS key ARN, the form EC2 reports the key of a snapshot in
+	kmsKeyARNPattern = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:key/[0-9a-zA-Z-]+$`)
+)
+
+// shareCmd lets another AWS account create volumes from the latest snapshot of a profile
+var shareCmd = &cobra.Command{
+	Use:   "share [profile]",
+	Short: "Share the latest snapshot of a profile with another AWS account",
+	Long: `Share the latest snapshot of a profile with another AWS account.
+Encrypted snapshots can only be shared with a customer managed KMS key the other account may use.
+Pass the ARN of that key with --kms-key; if the snapshot uses another key it is re-encrypted first.
+The other account then runs dumie import <snapshot-id> --as <profile>.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		if !accountIDPattern.MatchString(shareAccountFlag) {
+			fmt.Printf("Invalid account ID %q (expected 12 digits)\n", shareAccountFlag)
+			return
+		}
+
+		if shareKMSKeyFlag != "" && !kmsKeyARNPattern.MatchString(shareKMSKeyFlag) {
+			fmt.Printf("Invalid --kms-key %q (expected a key ARN such as arn:aws:kms:<region>:<account>:key/<key-id>)\n", shareKMSKeyFlag)
+			return
+		}
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "share")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		snapshot, err := ec2utils.LatestSnapshot(ctx, ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find snapshots for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if snapshot == nil {
+			fmt.Printf("Profile [%s] has no completed snapshot to share\n", profile)
+			return
+		}
+		snapshotID := aws.ToString(snapshot.SnapshotId)
+
+		if aws.ToBool(snapshot.Encrypted) {
+			if shareKMSKeyFlag == "" {
+				fmt.Printf("Snapshot [%s] is encrypted with KMS key %s. Pass --kms-key with the ARN of a customer managed key shared with account %s.\n",
+					snapshotID, aws.ToString(snapshot.KmsKeyId), shareAccountFlag)
+				return
+			}
+			if shareKMSKeyFlag != aws.ToString(snapshot.KmsKeyId) {
+				fmt.Printf("Re-encrypting snapshot [%s] with KMS key %s...\n", snapshotID, shareKMSKeyFlag)
+				snapshotID, err = ec2utils.ReencryptSnapshot(ctx, ec2Client, cfg.RegionFor(profile), profile, *snapshot, shareKMSKeyFlag)
+				if err != nil {
+					fmt.Printf("Failed to re-encrypt snapshot: %v\n", err)
+					return
+				}
+			}
+		}
+
+		if err := ec2utils.ShareSnapshot(ctx, ec2Client, snapshotID, shareAccountFlag); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Printf("Snapshot [%s] of profile [%s] shared with account %s.\n", snapshotID, profile, shareAccountFlag)
+		fmt.Printf("In that account, run: dumie import %s --as <profile> --region %s\n", snapshotID, cfg.RegionFor(profile))
+	},
+}
+
+// importCmd copies a snapshot shared by another account into this account as a Dumie profile
+var importCmd = &cobra.Command{
+	Use:   "import [snapshot-id]",
+	Short: "Import a snapshot shared by another account as a Dumie profile",
+	Long: `Copy a snapshot shared by another AWS account into this account and tag it as the newest
+snapshot of the profile given with --as. The next dumie use restores the profile from it.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		snapshotID := args[0]
+		profile := importAsFlag
+		ctx := cmd.Context()
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "import")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		cfg, err := common.LoadAWSConfig()
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			return
+		}
+
+		sourceRegion := importRegionFlag
+		if sourceRegion == "" {
+			sourceRegion = cfg.RegionFor(profile)
+		}
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		sourceEC2, err := common.GetEC2ClientForRegion(sourceRegion)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client for %s: %v\n", sourceRegion, err)
+			return
+		}
+
+		existing, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if existing != nil {
+			fmt.Printf("Warning: profile [%s] has a running instance [%s]; the import is used on its next restore.\n", profile, *existing)
+		}
+
+		fmt.Printf("Importing snapshot [%s] as profile [%s]...\n", snapshotID, profile)
+		copyID, err := ec2utils.ImportSnapshot(ctx, ec2Client, sourceEC2, snapshotID, profile, importKMSKeyFlag)
+		if err != nil {
+			fmt.Printf("Failed to import snapshot [%s]: %v\n", snapshotID, err)
+			return
+		}
+
+		// A running instance keeps its record; the import is only used on its next restore
+		if existing == nil {
+			registry, err := newRegistry(profile)
+			if err != nil {
+				fmt.Printf("Warning: cannot record profile state: %v\n", err)
+			}
+			recordState(ctx, registry, profile, ddb.StateArchived, ddb.RecordUpdate{SnapshotID: copyID, Spec: ec2utils.Policy{}.Spec()})
+		}
+
+		fmt.Printf("Snapshot [%s] imported as [%s] for profile [%s]. Run dumie use %s to start it.\n", snapshotID, copyID, profile, profile)
+	},
+}
+
+func init() {
+	shareCmd.Flags().StringVar(&shareAccountFlag, "account", "", "ID of the AWS account to share the snapshot with")
+	shareCmd.MarkFlagRequired("account")
+	shareCmd.Flags().StringVar(&shareKMSKeyFlag, "kms-key", "", "ARN of the customer managed KMS key to share encrypted snapshots with")
+	rootCmd.AddCommand(shareCmd)
+
+	importCmd.Flags().StringVar(&importAsFlag, "as", "", "Profile to import the snapshot as")
+	importCmd.MarkFlagRequired("as")
+	importCmd.Flags().StringVar(&importRegionFlag, "region", "", "Region of the shared snapshot (default: the profile's region)")
+	importCmd.Flags().StringVar(&importKMSKeyFlag, "kms-key", "", "KMS key to encrypt the imported copy with")
+	rootCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/iam"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotIDFlag    string
+	snapshotForceFlag bool
+)
+
+// snapshotCmd groups the commands that manage the archive snapshots of a profile
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "List, create, restore and delete the snapshots of a profile",
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list [profile]",
+	Short: "List the snapshots of a profile, newest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		snapshots, err := ec2utils.ListProfileSnapshots(ctx, ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to list snapshots for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if len(snapshots) == 0 {
+			fmt.Printf("No snapshots found for profile [%s]\n", profile)
+			return
+		}
+
+		fmt.Printf("\n%-24s %-20s %-10s %-6s %-10s %-8s %s\n", "SNAPSHOT ID", "CREATED", "STATE", "GIB", "ENCRYPTED", "SOURCE", "REASON")
+		for _, snap := range snapshots {
+			createdAt := "-"
+			if snap.StartTime != nil {
+				createdAt = snap.StartTime.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-24s %-20s %-10s %-6d %-10t %-8s %s\n",
+				aws.ToString(snap.SnapshotId), createdAt, snap.State, aws.ToInt32(snap.VolumeSize), aws.ToBool(snap.Encrypted),
+				snapshotTag(snap, ec2utils.ArchiveSourceTag), snapshotTag(snap, ec2utils.ArchiveReasonTag))
+		}
+	},
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create [profile]",
+	Short: "Take a checkpoint of a running instance without terminating it",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "snapshot create")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		fmt.Printf("Creating checkpoint snapshot for profile [%s]...\n", profile)
+		snapshotID, err := ec2utils.Archive(ctx, ec2Client, ec2utils.ArchiveOptions{
+			Profile: profile,
+			Source:  ec2utils.ArchiveSourceCLI,
+			Reason:  "checkpoint with dumie snapshot create",
+			Logger:  warnings,
+		})
+		if err != nil {
+			fmt.Printf("Failed to create snapshot for profile [%s]: %v\n", profile, err)
+			return
+		}
+		fmt.Printf("Snapshot [%s] created for profile [%s]. The instance keeps running.\n", snapshotID, profile)
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore [profile]",
+	Short: "Launch the profile's instance from a specific snapshot",
+	Long: `Launch the profile's instance from the snapshot given with --id instead of the newest one.
+The profile must not have a running instance; archive it first with dumie delete.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "snapshot restore")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		existing, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if existing != nil {
+			fmt.Printf("Profile [%s] already has a running instance [%s]. Archive it with dumie delete first.\n", profile, *existing)
+			return
+		}
+
+		snapshot, err := ec2utils.GetProfileSnapshot(ctx, ec2Client, profile, snapshotIDFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		iamClient, err := common.GetIAMClient()
+		if err != nil {
+			fmt.Printf("Failed to get IAM client: %v\n", err)
+			return
+		}
+		roleARN, err := iam.GetInstanceManagerRoleARN(iamClient)
+		if err != nil {
+			fmt.Printf("Failed to get IAM role ARN: %v\n", err)
+			return
+		}
+
+		registry, err := newRegistry(profile)
+		if err != nil {
+			fmt.Printf("Warning: cannot record profile state: %v\n", err)
+		}
+
+		recordState(ctx, registry, profile, ddb.StateCreating, ddb.RecordUpdate{SnapshotID: snapshotIDFlag, Spec: ec2utils.GetPolicy(snapshot.Tags).Spec()})
+		instanceID, err := ec2utils.RestoreFromSnapshot(ctx, ec2Client, profile, *snapshot, &roleARN, ec2utils.GetPolicy(snapshot.Tags))
+		if err != nil {
+			recordState(context.WithoutCancel(ctx), registry, profile, ddb.StateFailed, ddb.RecordUpdate{Error: err.Error()})
+			fmt.Printf("Failed to restore profile [%s] from snapshot [%s]: %v\n", profile, snapshotIDFlag, err)
+			return
+		}
+		recordState(ctx, registry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: instanceID})
+		fmt.Printf("Instance [%s] restored from snapshot [%s] for profile [%s]\n", instanceID, snapshotIDFlag, profile)
+	},
+}
+
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete [profile]",
+	Short: "Delete a snapshot of a profile",
+	Long: `Delete the snapshot given with --id and any AMI registered from it.
+Deleting the last snapshot of a profile without a running instance loses its data and needs --force.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		profile := args[0]
+		ctx := cmd.Context()
+
+		ctx, release, err := acquireProfileLock(ctx, profile, "snapshot delete")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer release()
+
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
+		if err != nil {
+			fmt.Printf("Failed to create EC2 client: %v\n", err)
+			return
+		}
+
+		if _, err := ec2utils.GetProfileSnapshot(ctx, ec2Client, profile, snapshotIDFlag); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if !snapshotForceFlag {
+			latest, err := ec2utils.LatestSnapshot(ctx, ec2Client, profile)
+			if err != nil {
+				fmt.Printf("Failed to list snapshots for profile [%s]: %v\n", profile, err)
+				return
+			}
+			existing, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+			if err != nil {
+				fmt.Printf("Failed to find instance for profile [%s]: %v\n", profile, err)
+				return
+			}
+			if existing == nil && latest != nil && aws.ToString(latest.SnapshotId) == snapshotIDFlag {
+				fmt.Printf("Snapshot [%s] is the newest archive of profile [%s], which has no running instance. Use --force to delete it anyway.\n", snapshotIDFlag, profile)
+				return
+			}
+		}
+
+		if err := ec2utils.DeleteSnapshotAndAMIIfExists(ctx, ec2Client, snapshotIDFlag, profile); err != nil {
+			fmt.Printf("Failed to delete snapshot [%s]: %v\n", snapshotIDFlag, err)
+			return
+		}
+
+		// A profile with neither an instance nor archives is gone, and so is its security group
+		remaining, err := ec2utils.ListProfileSnapshots(ctx, ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Warning: failed to list snapshots for profile [%s]: %v\n", profile, err)
+			return
+		}
+		existing, err := ec2utils.SearchEC2Instance(ec2Client, profile)
+		if err != nil {
+			fmt.Printf("Warning: failed to find instance for profile [%s]: %v\n", profile, err)
+			return
+		}
+		if len(remaining) == 0 && existing == nil {
+			if err := ec2utils.DeleteProfileSecurityGroup(ctx, ec2Client, profile); err != nil {
+				fmt.Printf("Warning: %v. dumie gc removes it later.\n", err)
+			}
+		}
+	},
+}
+
+// snapshotTag returns the value of a snapshot tag, or "-" if it is not set
+func snapshotTag(snap types.Snapshot, key string) string {
+	for _, tag := range snap.Tags {
+		if aws.ToString(tag.Key) == key && aws.ToString(tag.Value) != "" {
+			return *tag.Value
+		}
+	}
+	return "-"
+}
+
+func init() {
+	snapshotRestoreCmd.Flags().StringVar(&snapshotIDFlag, "id", "", "ID of the snapshot to restore (snap-...)")
+	snapshotRestoreCmd.MarkFlagRequired("id")
+	snapshotDeleteCmd.Flags().StringVar(&snapshotIDFlag, "id", "", "ID of the snapshot to delete (snap-...)")
+	snapshotDeleteCmd.MarkFlagRequired("id")
+	snapshotDeleteCmd.Flags().BoolVar(&snapshotForceFlag, "force", false, "Delete the snapshot even if it is the newest archive of the profile")
+
+	snapshotCmd.AddCommand(snapshotListCmd, snapshotCreateCmd, snapshotRestoreCmd, snapshotDeleteCmd)
+	rootCmd.AddCommand(snapshotCmd)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+)
+
+// sshTarget is the instance of a profile an ssh command connects to
+type sshTarget struct {
+	Profile    string
+	InstanceID string
+	PublicDNS  string
+}
+
+// sshArgs builds the ssh arguments that reach a Dumie instance as ec2-user with the configured
+// key pair, after checking the host keys of the instance against the ones pinned for the profile.
+// Extra options go before the destination, the remote command after it.
+func sshArgs(ctx context.Context, client *ec2.Client, target sshTarget, options []string, remoteCommand ...string) ([]string, error) {
+	keyPairName, err := common.GetKeyPairName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key pair name: %v", err)
+	}
+
+	keyFilePath := filepath.Join(".", fmt.Sprintf("%s.pem", keyPairName))
+	if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("private key file not found: %s", keyFilePath)
+	}
+
+	knownHosts, err := pinHostKeys(ctx, client, target.Profile, target.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The alias ties the pinned keys to the profile rather than to the public DNS name, which
+	// changes with every instance
+	args := []string{
+		"-i", keyFilePath,
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + knownHosts,
+		"-o", "HostKeyAlias=" + hostKeyAlias(target.Profile),
+	}
+	args = append(args, options...)
+	args = append(args, fmt.Sprintf("ec2-user@%s", target.PublicDNS))
+	args = append(args, remoteCommand...)
+
+	return args, nil
+}
+
+// allowSSHFromHere limits SSH access to an instance to this machine's public IP, replacing the rule
+// from its previous address and revoking rules other users stopped refreshing
+func allowSSHFromHere(ctx context.Context, client *ec2.Client, instanceID string) error {
+	cfg, err := common.LoadAWSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	cidr, err := common.CallerCIDR(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("%w (set allowed_ip in the config to skip detection)", err)
+	}
+
+	return ec2utils.AllowSSHToInstance(ctx, client, instanceID, cidr, sshRuleOwner(), cfg.IPRuleMaxAge())
+}
+
+// sshRuleOwner names the user of this machine in security group rule descriptions, which only
+// allow a small set of characters
+func sshRuleOwner() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		name += "@" + host
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("._-@", r):
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 
+	"github.com/dumie-org/dumie-cli/internal/agent"
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/spf13/cobra"
 )
 
@@ -19,10 +22,10 @@ var statusCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := args[0]
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(cmd.Context(), 10*time.Second)
 		defer cancel()
 
-		client, err := common.GetEC2AWSClient()
+		client, err := common.GetEC2ClientForProfile(profile)
 		if err != nil {
 			fmt.Println("Failed to create EC2 client:", err)
 			return
@@ -60,14 +63,20 @@ var statusCmd = &cobra.Command{
 
 		if selected != nil {
 			var source = "base AMI"
-			var timeoutSeconds = "60" // default
 			for _, tag := range selected.Tags {
 				if *tag.Key == "Restored" && *tag.Value == "true" {
 					source = "snapshot"
 				}
-				if *tag.Key == "TimeoutSeconds" {
-					timeoutSeconds = *tag.Value
-				}
+			}
+			policy := ec2utils.GetPolicy(selected.Tags)
+
+			ttl := "-"
+			if policy.TTL > 0 {
+				ttl = policy.TTL.String()
+			}
+			schedule := "-"
+			if policy.Schedule != "" {
+				schedule = policy.Schedule + " UTC"
 			}
 
 			publicIP := "-"
@@ -87,44 +96,149 @@ var statusCmd = &cobra.Command{
 			fmt.Printf("Public IP:   %s\n", publicIP)
 			fmt.Printf("Launch Time: %s\n", launchTime)
 			fmt.Printf("Source:      %s\n", source)
-			fmt.Printf("Timeout:     %s seconds\n", timeoutSeconds)
+			fmt.Printf("Timeout:     %d seconds\n", policy.TimeoutSeconds)
+			fmt.Printf("TTL:         %s\n", ttl)
+			fmt.Printf("Schedule:    %s\n", schedule)
+			fmt.Printf("Retention:   %s\n", policy.RetentionString())
+			if encryption, err := ec2utils.VolumeEncryption(ctx, client, *selected); err == nil {
+				fmt.Printf("Encryption:  %s\n", encryption)
+			}
+			fmt.Printf("Pinned:      %s\n", ec2utils.GetPinInfo(selected.Tags))
+			printRegistryState(ctx, profile, selected)
+
+			if selected.State.Name == types.InstanceStateNameRunning {
+				hb, err := getHeartbeat(ctx, profile)
+				if err != nil {
+					fmt.Printf("Monitor:     unknown (%v)\n", err)
+					return
+				}
+				fmt.Printf("Monitor:     %s\n", monitorStatus(hb, *selected.InstanceId))
+				if hb != nil && hb.InstanceID == *selected.InstanceId && !hb.Stale(time.Now()) {
+					fmt.Printf("Sessions:    %d\n", hb.ActiveSessions)
+					fmt.Printf("Idle:        %s\n", (time.Duration(hb.IdleSeconds) * time.Second).String())
+					fmt.Printf("Agent:       %s\n", hb.AgentVersion)
+					if hb.LastError != "" {
+						fmt.Printf("Last error:  %s (%s)\n", hb.LastError, hb.LastErrorAt.Local().Format("2006-01-02 15:04:05"))
+					}
+				}
+				printHookReports(ctx, profile)
+			}
 		} else {
 			fmt.Println("No active instance found for this profile.")
+			printRegistryState(ctx, profile, nil)
 			checkSnapshot(ctx, client, profile)
 		}
 	},
 }
 
-func checkSnapshot(ctx context.Context, client *ec2.Client, profile string) {
-	snapInput := &ec2.DescribeSnapshotsInput{
-		Filters: []types.Filter{
-			{
-				Name:   aws.String("tag:ManagedBy"),
-				Values: []string{"Dumie"},
-			},
-			{
-				Name:   aws.String("tag:Name"),
-				Values: []string{profile},
-			},
-		},
-		OwnerIds: []string{"self"},
+// printRegistryState shows the state the registry records for a profile and whether it
+// matches the instance found in EC2
+func printRegistryState(ctx context.Context, profile string, instance *types.Instance) {
+	registry, err := newRegistry(profile)
+	if err != nil {
+		return
+	}
+	record, err := registry.Get(ctx, profile)
+	if err != nil {
+		fmt.Printf("Registry:    unknown (%v)\n", err)
+		return
+	}
+	if record == nil {
+		fmt.Println("Registry:    not registered (run dumie reconcile)")
+		return
+	}
+
+	state := fmt.Sprintf("%s since %s", record.State, record.UpdatedAt.Local().Format("2006-01-02 15:04:05"))
+	live := instance != nil && instance.State.Name != types.InstanceStateNameTerminated && instance.State.Name != types.InstanceStateNameShuttingDown
+	switch {
+	case live && (!record.State.Active() || record.InstanceID != aws.ToString(instance.InstanceId)):
+		state += " (out of date, run dumie reconcile)"
+	case !live && record.State == ddb.StateRunning:
+		state += " (instance is gone, run dumie reconcile)"
+	}
+	fmt.Printf("Registry:    %s\n", state)
+	if record.Error != "" {
+		fmt.Printf("Last failure: %s\n", record.Error)
+	}
+}
+
+func getHeartbeat(ctx context.Context, profile string) (*ddb.Heartbeat, error) {
+	heartbeats, err := newAgentStore(profile)
+	if err != nil {
+		return nil, err
 	}
-	output, err := client.DescribeSnapshots(ctx, snapInput)
+	return heartbeats.GetHeartbeat(ctx, profile)
+}
+
+func newAgentStore(profile string) (*ddb.AgentStore, error) {
+	ddbClient, err := common.GetDynamoDBClientForProfile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DynamoDB client: %w", err)
+	}
+	return ddb.NewAgentStore(ddbClient), nil
+}
+
+// printHookReports summarizes the last pre-archive and post-restore hook runs of a profile
+func printHookReports(ctx context.Context, profile string) {
+	store, err := newAgentStore(profile)
+	if err != nil {
+		return
+	}
+
+	for _, stage := range []string{agent.PreArchiveStage, agent.PostRestoreStage} {
+		report, err := store.GetHookReport(ctx, profile, stage)
+		if err != nil || report == nil {
+			continue
+		}
+
+		failed := 0
+		for _, r := range report.Results {
+			if r.Failed() {
+				failed++
+			}
+		}
+		fmt.Printf("Hooks:       %s ran %d hook(s), %d failed (%s)\n",
+			stage, len(report.Results), failed, report.RanAt.Local().Format("2006-01-02 15:04:05"))
+		for _, r := range report.Results {
+			if r.Failed() {
+				fmt.Printf("             - %s exited %d: %s\n", r.Name, r.ExitCode, r.Error)
+			}
+		}
+	}
+}
+
+// monitorStatus describes whether the agent on a running instance is reporting heartbeats
+func monitorStatus(hb *ddb.Heartbeat, instanceID string) string {
+	if hb == nil || hb.InstanceID != instanceID {
+		return "monitor not running (no heartbeat)"
+	}
+
+	age := time.Since(hb.LastSeen).Round(time.Second)
+	if hb.Stale(time.Now()) {
+		return fmt.Sprintf("monitor not running (last heartbeat %s ago)", age)
+	}
+	return fmt.Sprintf("running (last heartbeat %s ago)", age)
+}
+
+func checkSnapshot(ctx context.Context, client *ec2.Client, profile string) {
+	snapshots, err := ec2utils.ListProfileSnapshots(ctx, client, profile)
 	if err != nil {
 		fmt.Println("Error checking snapshots:", err)
 		return
 	}
 
-	if len(output.Snapshots) > 0 {
-		fmt.Printf("\nFound %d snapshot(s) for profile [%s]:\n", len(output.Snapshots), profile)
-		for _, snap := range output.Snapshots {
+	if len(snapshots) > 0 {
+		fmt.Printf("\nFound %d snapshot(s) for profile [%s]:\n", len(snapshots), profile)
+		for _, snap := range snapshots {
 			createdAt := "-"
 			if snap.StartTime != nil {
 				createdAt = snap.StartTime.Local().Format("2006-01-02 15:04:05")
 			}
 			fmt.Printf("- Snapshot ID: %s\n", *snap.SnapshotId)
 			fmt.Printf("  Created At:  %s\n", createdAt)
-			fmt.Printf("  Size (GiB):  %d\n", snap.VolumeSize)
+			fmt.Printf("  State:       %s\n", snap.State)
+			fmt.Printf("  Encrypted:   %t\n", aws.ToBool(snap.Encrypted))
+			fmt.Printf("  Size (GiB):  %d\n", aws.ToInt32(snap.VolumeSize))
 		}
 	} else {
 		fmt.Printf("No instance or snapshot found for profile [%s].\n", profile)
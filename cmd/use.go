@@ -5,36 +5,27 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
 	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
 	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
 	"github.com/dumie-org/dumie-cli/internal/aws/iam"
+	"github.com/dumie-org/dumie-cli/internal/userdata"
+	"github.com/dumie-org/dumie-cli/internal/version"
 	"github.com/spf13/cobra"
 )
 
-func connectToInstance(instanceID, publicDNS string) error {
-	keyPairName, err := common.GetKeyPairName()
+func connectToInstance(ctx context.Context, client *ec2.Client, target sshTarget) error {
+	args, err := sshArgs(ctx, client, target, nil)
 	if err != nil {
-		return fmt.Errorf("failed to get key pair name: %v", err)
+		return err
 	}
 
-	keyFilePath := filepath.Join(".", fmt.Sprintf("%s.pem", keyPairName))
-	if _, err := os.Stat(keyFilePath); os.IsNotExist(err) {
-		return fmt.Errorf("private key file not found: %s", keyFilePath)
-	}
-
-	sshArgs := []string{
-		"-i", keyFilePath,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		fmt.Sprintf("ec2-user@%s", publicDNS),
-	}
-
-	fmt.Printf("Connecting to instance [%s] at %s...\n", instanceID, publicDNS)
-	sshCmd := exec.Command("ssh", sshArgs...)
+	fmt.Printf("Connecting to instance [%s] at %s...\n", target.InstanceID, target.PublicDNS)
+	sshCmd := exec.Command("ssh", args...)
 	sshCmd.Stdin = os.Stdin
 	sshCmd.Stdout = os.Stdout
 	sshCmd.Stderr = os.Stderr
@@ -42,7 +33,7 @@ func connectToInstance(instanceID, publicDNS string) error {
 	return sshCmd.Run()
 }
 
-func createNewInstance(profile string, timeoutSeconds int) (string, error) {
+func createNewInstance(ctx context.Context, profile string, policy ec2utils.Policy) (string, error) {
 	iamClient, err := common.GetIAMClient()
 	if err != nil {
 		return "", fmt.Errorf("failed to get IAM client: %v", err)
@@ -53,11 +44,71 @@ func createNewInstance(profile string, timeoutSeconds int) (string, error) {
 		return "", fmt.Errorf("failed to get IAM role ARN: %v", err)
 	}
 
-	userDataPath := filepath.Join("scripts", "user_data", "ssh_monitor.sh")
-	return ec2utils.RestoreOrCreateInstance(context.TODO(), profile, &userDataPath, &roleARN, timeoutSeconds)
+	cfg, err := common.LoadAWSConfig()
+	if err != nil {
+		return "", fmt.Errorf("failed to load config: %v", err)
+	}
+
+	// The --user-data flag takes precedence over the configured template
+	templatePath := userDataFlag
+	if templatePath == "" {
+		templatePath = cfg.UserDataTemplate
+	}
+
+	// Only a release knows the checksums to verify the agent it downloads
+	agentVersion := ""
+	if version.Released() {
+		agentVersion = version.Version
+	} else if templatePath == "" {
+		fmt.Println("Warning: this is a development build, so the instance gets no agent and is not archived automatically. Pass --user-data to install one.")
+	}
+
+	userData, err := userdata.Render(userdata.Params{
+		Profile:          profile,
+		Region:           cfg.RegionFor(profile),
+		LockTable:        cfg.LockTableName(),
+		TimeoutSeconds:   policy.TimeoutSeconds,
+		AgentVersion:     agentVersion,
+		AgentSHA256AMD64: version.AgentSHA256AMD64,
+		AgentSHA256ARM64: version.AgentSHA256ARM64,
+	}, templatePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to render user data: %v", err)
+	}
+
+	return ec2utils.RestoreOrCreateInstance(ctx, profile, &userData, &roleARN, policy)
 }
 
-var timeoutFlag int
+var (
+	timeoutFlag    int
+	ttlFlag        time.Duration
+	scheduleFlag   string
+	retainLastFlag int
+	retainDaysFlag int
+	encryptionFlag string
+	userDataFlag   string
+)
+
+// policyUpdateFromFlags collects the archive policy flags that were explicitly set on the command line
+func policyUpdateFromFlags(cmd *cobra.Command) ec2utils.PolicyUpdate {
+	var update ec2utils.PolicyUpdate
+	if cmd.Flags().Changed("timeout") {
+		update.TimeoutSeconds = &timeoutFlag
+	}
+	if cmd.Flags().Changed("ttl") {
+		update.TTL = &ttlFlag
+	}
+	if cmd.Flags().Changed("schedule") {
+		update.Schedule = &scheduleFlag
+	}
+	if cmd.Flags().Changed("retain-last") {
+		update.RetainLast = &retainLastFlag
+	}
+	if cmd.Flags().Changed("retain-days") {
+		update.RetainDays = &retainDaysFlag
+	}
+	return update
+}
 
 var useCmd = &cobra.Command{
 	Use:   "use [profile]",
@@ -67,20 +118,41 @@ If no instance exists for the profile, it will create one with SSH monitoring en
 If an instance exists, it will connect to it.
 
 The SSH monitoring will automatically terminate the instance after the specified timeout
-when no SSH sessions are active.`,
+when no SSH sessions are active. It can also archive the instance a fixed time after boot (--ttl)
+or at a daily UTC time (--schedule). For an existing instance these flags update its policy tags.
+
+Old snapshots of the profile are pruned after a restore. By default the last 3 are kept;
+use --retain-last or --retain-days to change the retention.`,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		profile := args[0]
-		ctx := context.TODO()
+		ctx := cmd.Context()
+
+		if timeoutFlag <= 0 {
+			fmt.Printf("Invalid --timeout %d: it must be a positive number of seconds\n", timeoutFlag)
+			return
+		}
+		if scheduleFlag != "" {
+			if err := ec2utils.ParseSchedule(scheduleFlag); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		encryption, err := ec2utils.ParseEncryption(encryptionFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
 
 		// Initialize DynamoDB lock
-		ddbClient, err := common.GetDynamoDBAWSClient()
+		ddbClient, err := common.GetDynamoDBClientForProfile(profile)
 		if err != nil {
 			fmt.Printf("Failed to get DynamoDB client: %v\n", err)
 			return
 		}
 
 		lock := ddb.NewDynamoDBLock(ddbClient)
+		lock.Operation = "use"
 
 		// Check if table exists, create if it doesn't
 		exists, err := ddb.SearchDynamoDBLockTable(ddbClient)
@@ -95,35 +167,41 @@ when no SSH sessions are active.`,
 			}
 		}
 
-		// Try to acquire lock for this profile with retry
-		lockID := fmt.Sprintf("profile-%s", profile)
-		startTime := time.Now()
-		maxRetryTime := 10 * time.Minute
-		retryInterval := 5 * time.Second
-
-		for {
-			err := lock.AcquireLock(ctx, lockID)
-			if err == nil {
-				break
-			}
-
-			elapsed := time.Since(startTime)
-			if elapsed >= maxRetryTime {
-				fmt.Printf("Failed to acquire lock after %v: %v\n", maxRetryTime, err)
-				return
-			}
+		// Wait for the lock of this profile while another process creates or archives the instance
+		lockID := ddb.ProfileLockID(profile)
+		err = lock.WaitForLock(ctx, lockID, lockTimeoutFlag, func(held *ddb.ErrLockHeld, elapsed time.Duration) {
+			fmt.Printf("The instance is being created or in the termination process (%v). Retrying... (elapsed: %v)\n", held, elapsed.Round(time.Second))
+		})
+		if err != nil {
+			fmt.Printf("Failed to acquire lock: %v\n", err)
+			return
+		}
 
-			fmt.Printf("The instance is being created or in the termination process. Retrying to connect to the instance... (elapsed: %v)\n", elapsed.Round(time.Second))
-			time.Sleep(retryInterval)
+		// Keep the lock while the instance is restored or created, but not during the SSH session
+		lease := lock.KeepAlive(ctx, lockID)
+		var releaseOnce sync.Once
+		releaseLock := func() {
+			releaseOnce.Do(func() {
+				if err := lease.Stop(); err != nil {
+					fmt.Printf("Warning: %v\n", err)
+					return
+				}
+				// Release even when the command was interrupted
+				if err := lock.ReleaseLock(context.WithoutCancel(ctx), lockID); err != nil {
+					fmt.Printf("Warning: %v\n", err)
+				}
+			})
 		}
-		defer lock.ReleaseLock(ctx, lockID)
+		defer releaseLock()
 
-		ec2Client, err := common.GetEC2AWSClient()
+		ec2Client, err := common.GetEC2ClientForProfile(profile)
 		if err != nil {
 			fmt.Printf("Failed to get EC2 client: %v\n", err)
 			return
 		}
 
+		registry := ddb.NewRegistry(ddbClient)
+
 		instanceIDPtr, err := ec2utils.SearchEC2Instance(ec2Client, profile)
 		if err != nil {
 			fmt.Printf("Failed to find instance: %v\n", err)
@@ -133,22 +211,39 @@ when no SSH sessions are active.`,
 		var instanceID string
 		if instanceIDPtr == nil {
 			fmt.Printf("No instance found for profile [%s]. Creating new instance with %d second timeout...\n", profile, timeoutFlag)
-			instanceID, err = createNewInstance(profile, timeoutFlag)
+			policy := ec2utils.Policy{
+				TimeoutSeconds: timeoutFlag,
+				TTL:            ttlFlag,
+				Schedule:       scheduleFlag,
+				RetainLast:     retainLastFlag,
+				RetainDays:     retainDaysFlag,
+				Encryption:     encryption,
+			}
+			recordState(ctx, registry, profile, ddb.StateCreating, ddb.RecordUpdate{Spec: policy.Spec()})
+			instanceID, err = createNewInstance(lease.Context(), profile, policy)
 			if err != nil {
+				recordState(context.WithoutCancel(ctx), registry, profile, ddb.StateFailed, ddb.RecordUpdate{Error: err.Error()})
 				fmt.Printf("Failed to launch instance: %v\n", err)
 				return
 			}
+			recordState(ctx, registry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: instanceID})
+			if err := lease.Err(); err != nil {
+				fmt.Printf("Lost the lock of profile [%s] while creating instance [%s]: %v\n", profile, instanceID, err)
+				return
+			}
 		} else {
 			instanceID = *instanceIDPtr
-			
-			// Check if timeout flag is provided and update existing instance
-			if cmd.Flags().Changed("timeout") {
-				fmt.Printf("Updating timeout for existing instance [%s] to %d seconds...\n", instanceID, timeoutFlag)
-				err = ec2utils.UpdateInstanceTimeout(ctx, ec2Client, instanceID, timeoutFlag)
+			recordState(ctx, registry, profile, ddb.StateRunning, ddb.RecordUpdate{InstanceID: instanceID})
+
+			// Update the policy tags of the existing instance if any policy flag is provided
+			update := policyUpdateFromFlags(cmd)
+			if update != (ec2utils.PolicyUpdate{}) {
+				fmt.Printf("Updating archive policy for existing instance [%s]...\n", instanceID)
+				err = ec2utils.UpdateInstancePolicy(lease.Context(), ec2Client, instanceID, update)
 				if err != nil {
-					fmt.Printf("Warning: failed to update timeout: %v\n", err)
+					fmt.Printf("Warning: failed to update archive policy: %v\n", err)
 				} else {
-					fmt.Printf("Successfully updated timeout to %d seconds\n", timeoutFlag)
+					fmt.Println("Successfully updated archive policy. The monitor applies it on its next reload.")
 				}
 			}
 		}
@@ -163,12 +258,19 @@ when no SSH sessions are active.`,
 			return
 		}
 
-		err = ec2utils.DeleteOldSnapshotsByProfile(ctx, profile)
+		err = ec2utils.PruneProfileSnapshots(lease.Context(), ec2Client, profile)
 		if err != nil {
-			fmt.Println("Warning: failed to delete old snapshots:", err)
+			fmt.Println("Warning: failed to prune old snapshots:", err)
+		}
+
+		if err := allowSSHFromHere(lease.Context(), ec2Client, instanceID); err != nil {
+			fmt.Printf("Failed to allow SSH access from this machine: %v\n", err)
+			return
 		}
 
-		if err := connectToInstance(instanceID, publicDNS); err != nil {
+		releaseLock()
+
+		if err := connectToInstance(ctx, ec2Client, sshTarget{Profile: profile, InstanceID: instanceID, PublicDNS: publicDNS}); err != nil {
 			fmt.Printf("SSH connection failed: %v\n", err)
 			return
 		}
@@ -177,5 +279,11 @@ when no SSH sessions are active.`,
 
 func init() {
 	useCmd.Flags().IntVarP(&timeoutFlag, "timeout", "t", 60, "Timeout in seconds before terminating instance when no SSH sessions are active (default: 60)")
+	useCmd.Flags().DurationVar(&ttlFlag, "ttl", 0, "Archive the instance this long after it boots (e.g. 8h, 0 disables)")
+	useCmd.Flags().StringVar(&encryptionFlag, "encryption", "", "Volume encryption for new instances: none, default or a KMS key ARN (default: configured value)")
+	useCmd.Flags().StringVar(&userDataFlag, "user-data", "", "User data template to render for new instances instead of the built-in one")
+	useCmd.Flags().StringVar(&scheduleFlag, "schedule", "", "Archive the instance daily at this UTC time (HH:MM, empty disables)")
+	useCmd.Flags().IntVar(&retainLastFlag, "retain-last", 0, "Number of snapshots to keep for the profile (default: 3)")
+	useCmd.Flags().IntVar(&retainDaysFlag, "retain-days", 0, "Keep snapshots for this many days instead of a fixed number")
 	rootCmd.AddCommand(useCmd)
 }
@@ -0,0 +1,490 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+	"github.com/dumie-org/dumie-cli/internal/version"
+)
+
+const (
+	// DefaultPollInterval is how often the agent samples SSH sessions
+	DefaultPollInterval = 5 * time.Second
+
+	// DefaultPolicyReloadInterval is how often the agent re-reads its policy from the instance tags
+	DefaultPolicyReloadInterval = 30 * time.Second
+
+	// archiveRetryBase and archiveRetryMax bound the backoff between failed archive attempts
+	archiveRetryBase = time.Minute
+	archiveRetryMax  = 30 * time.Minute
+)
+
+// Metadata exposes the instance metadata the agent relies on
+type Metadata interface {
+	InstanceID(ctx context.Context) (string, error)
+	Tags(ctx context.Context) ([]types.Tag, error)
+}
+
+// SessionCounter reports how many SSH sessions are connected to the instance
+type SessionCounter interface {
+	ActiveSessions() (int, error)
+}
+
+// Locker is the subset of the DynamoDB lock used while archiving
+type Locker interface {
+	AcquireLock(ctx context.Context, lockID string) error
+	ReleaseLock(ctx context.Context, lockID string) error
+	KeepAlive(ctx context.Context, lockID string) *ddb.Lease
+}
+
+// StateWriter records the live state of the agent and the outcome of its hooks
+type StateWriter interface {
+	PutHeartbeat(ctx context.Context, hb ddb.Heartbeat) error
+	PutHookReport(ctx context.Context, report ddb.HookReport) error
+	PutLastWords(ctx context.Context, lw ddb.LastWords) error
+}
+
+// Registry records the lifecycle state of the profile
+type Registry interface {
+	Transition(ctx context.Context, profile string, to ddb.ProfileState, update ddb.RecordUpdate) error
+}
+
+// Archiver snapshots and terminates the instance
+type Archiver interface {
+	Archive(ctx context.Context, instanceID, profile, reason string) (string, error)
+	Terminate(ctx context.Context, instanceID string) error
+}
+
+// Agent archives and terminates the instance it runs on once its policy says so
+type Agent struct {
+	Metadata Metadata
+	Sessions SessionCounter
+	Locker   Locker
+	Archiver Archiver
+	State    StateWriter
+	Registry Registry
+	Hooks    HookRunner
+	Logger   *log.Logger
+
+	PollInterval          time.Duration
+	PolicyReloadInterval  time.Duration
+	HeartbeatInterval     time.Duration
+	DefaultTimeoutSeconds int
+
+	// LogTail holds the recent log lines saved as last words before termination
+	LogTail *LogBuffer
+
+	// StateDir keeps markers that must survive agent restarts
+	StateDir string
+
+	// Now and Uptime are replaceable clocks for the archive decisions
+	Now    func() time.Time
+	Uptime func() (time.Duration, error)
+
+	instanceID    string
+	profile       string
+	policy        ec2utils.Policy
+	pin           ec2utils.PinInfo
+	lastReload    time.Time
+	lastHeartbeat time.Time
+	idleSince     time.Time
+
+	// Archive failures keep the instance alive and are retried with backoff
+	failures    int
+	retryAt     time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// New creates an agent backed by the instance metadata service, EC2, the given DynamoDB
+// lock table and the hooks in DefaultHooksDir
+func New(cfg aws.Config, lockTable string, logger *log.Logger) *Agent {
+	ddbClient := dynamodb.NewFromConfig(cfg)
+	lock := ddb.NewDynamoDBLock(ddbClient)
+	lock.TableName = lockTable
+	lock.Operation = "archive"
+	state := ddb.NewAgentStore(ddbClient)
+	state.TableName = lockTable
+	registry := ddb.NewRegistry(ddbClient)
+	registry.TableName = lockTable
+
+	return &Agent{
+		Metadata:              NewIMDSMetadata(cfg),
+		Sessions:              &SSHSessionCounter{},
+		Locker:                lock,
+		Archiver:              &EC2Archiver{Client: ec2.NewFromConfig(cfg), Logger: logger},
+		State:                 state,
+		Registry:              registry,
+		Hooks:                 &DirHookRunner{Dir: DefaultHooksDir, Timeout: DefaultHookTimeout},
+		Logger:                logger,
+		PollInterval:          DefaultPollInterval,
+		PolicyReloadInterval:  DefaultPolicyReloadInterval,
+		HeartbeatInterval:     ddb.HeartbeatInterval,
+		DefaultTimeoutSeconds: ec2utils.DefaultTimeoutSeconds,
+		StateDir:              "/var/lib/dumie",
+		Now:                   time.Now,
+		Uptime:                ReadUptime,
+	}
+}
+
+// Run monitors the instance until it has been archived and terminated or ctx is cancelled
+func (a *Agent) Run(ctx context.Context) error {
+	instanceID, err := a.Metadata.InstanceID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get instance ID: %w", err)
+	}
+	a.instanceID = instanceID
+	a.policy = ec2utils.Policy{TimeoutSeconds: a.DefaultTimeoutSeconds}
+	a.idleSince = a.Now()
+
+	tags, err := a.Metadata.Tags(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read instance tags: %w", err)
+	}
+	a.applyTags(tags)
+	a.Logger.Printf("Monitoring instance %s (profile: %s)", a.instanceID, a.profile)
+
+	if tagValue(tags, "Restored") == "true" {
+		a.runPostRestoreHooks(ctx)
+	}
+
+	ticker := time.NewTicker(a.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if a.tick(ctx) {
+				return nil
+			}
+		}
+	}
+}
+
+// tick samples the instance once and reports whether it has been terminated
+func (a *Agent) tick(ctx context.Context) bool {
+	now := a.Now()
+
+	if now.Sub(a.lastReload) >= a.PolicyReloadInterval {
+		if err := a.reloadPolicy(ctx); err != nil {
+			a.Logger.Printf("Failed to reload policy, keeping the previous one: %v", err)
+		}
+	}
+
+	sessions, err := a.Sessions.ActiveSessions()
+	if err != nil {
+		// Never archive on a guess
+		a.Logger.Printf("Failed to count SSH sessions: %v", err)
+		sessions = 1
+	}
+	if sessions > 0 {
+		a.idleSince = now
+	}
+
+	if now.Sub(a.lastHeartbeat) >= a.HeartbeatInterval {
+		a.writeHeartbeat(ctx, now, sessions)
+	}
+
+	uptime, err := a.Uptime()
+	if err != nil {
+		a.Logger.Printf("Failed to read uptime: %v", err)
+	}
+
+	reason := archiveReason(a.policy, now.Sub(a.idleSince), uptime, now)
+	if reason == "" {
+		a.failures = 0
+		a.retryAt = time.Time{}
+		return false
+	}
+
+	if a.pin.Active(now) {
+		a.Logger.Printf("%s, but instance is pinned. Skipping archive.", reason)
+		a.idleSince = now
+		return false
+	}
+
+	if now.Before(a.retryAt) {
+		return false
+	}
+
+	a.Logger.Printf("%s. Archiving instance %s before termination...", reason, a.instanceID)
+	if err := a.archiveAndTerminate(ctx, reason); err != nil {
+		a.failures++
+		delay := retryBackoff(a.failures)
+		a.retryAt = now.Add(delay)
+		a.lastError = err.Error()
+		a.lastErrorAt = now
+		a.Logger.Printf("Archive failed, keeping the instance and retrying in %s: %v", delay, err)
+		a.writeHeartbeat(ctx, now, sessions)
+		return false
+	}
+
+	return true
+}
+
+func (a *Agent) writeHeartbeat(ctx context.Context, now time.Time, sessions int) {
+	if a.profile == "" {
+		return
+	}
+
+	err := a.State.PutHeartbeat(ctx, ddb.Heartbeat{
+		Profile:        a.profile,
+		InstanceID:     a.instanceID,
+		LastSeen:       now,
+		ActiveSessions: sessions,
+		IdleSeconds:    int(now.Sub(a.idleSince).Seconds()),
+		AgentVersion:   version.Version,
+		LastError:      a.lastError,
+		LastErrorAt:    a.lastErrorAt,
+	})
+	if err != nil {
+		a.Logger.Printf("Failed to write heartbeat: %v", err)
+		return
+	}
+	a.lastHeartbeat = now
+}
+
+func (a *Agent) reloadPolicy(ctx context.Context) error {
+	tags, err := a.Metadata.Tags(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read instance tags: %w", err)
+	}
+	a.applyTags(tags)
+	return nil
+}
+
+func (a *Agent) applyTags(tags []types.Tag) {
+	a.profile = tagValue(tags, "Name")
+	a.policy = ec2utils.GetPolicy(tags)
+	if tagValue(tags, ec2utils.TimeoutSecondsTag) == "" {
+		a.policy.TimeoutSeconds = a.DefaultTimeoutSeconds
+	}
+	a.pin = ec2utils.GetPinInfo(tags)
+	a.lastReload = a.Now()
+}
+
+// runHooks runs the hooks of a stage, records their exit status and reports whether any failed
+func (a *Agent) runHooks(ctx context.Context, stage string) bool {
+	env := []string{
+		"DUMIE_PROFILE=" + a.profile,
+		"DUMIE_INSTANCE_ID=" + a.instanceID,
+	}
+
+	ranAt := a.Now()
+	results, err := a.Hooks.RunHooks(ctx, stage, env)
+	if err != nil {
+		a.Logger.Printf("Failed to run %s hooks: %v", stage, err)
+		results = append(results, ddb.HookResult{Name: stage, ExitCode: -1, Error: err.Error()})
+	}
+	if len(results) == 0 {
+		return false
+	}
+
+	failed := false
+	for _, r := range results {
+		if r.Failed() {
+			failed = true
+			a.Logger.Printf("%s hook %s failed with exit code %d after %s: %s", stage, r.Name, r.ExitCode, r.Duration.Round(time.Millisecond), r.Error)
+		} else {
+			a.Logger.Printf("%s hook %s succeeded after %s", stage, r.Name, r.Duration.Round(time.Millisecond))
+		}
+	}
+
+	err = a.State.PutHookReport(ctx, ddb.HookReport{
+		Profile:    a.profile,
+		InstanceID: a.instanceID,
+		Stage:      stage,
+		RanAt:      ranAt,
+		Results:    results,
+	})
+	if err != nil {
+		a.Logger.Printf("Failed to record %s hook results: %v", stage, err)
+	}
+
+	return failed
+}
+
+// runPostRestoreHooks runs the post-restore hooks once per restored instance
+func (a *Agent) runPostRestoreHooks(ctx context.Context) {
+	marker := filepath.Join(a.StateDir, fmt.Sprintf("post-restore-%s", a.instanceID))
+	if _, err := os.Stat(marker); err == nil {
+		return
+	}
+
+	a.runHooks(ctx, PostRestoreStage)
+
+	if err := os.MkdirAll(a.StateDir, 0755); err != nil {
+		a.Logger.Printf("Failed to create state directory %s: %v", a.StateDir, err)
+		return
+	}
+	if err := os.WriteFile(marker, []byte(a.Now().UTC().Format(time.RFC3339)+"\n"), 0644); err != nil {
+		a.Logger.Printf("Failed to write post-restore marker: %v", err)
+	}
+}
+
+func (a *Agent) archiveAndTerminate(ctx context.Context, reason string) error {
+	if a.profile == "" {
+		return fmt.Errorf("instance %s has no Name tag", a.instanceID)
+	}
+
+	// A snapshot left by an archive whose terminate failed is not taken again
+	snapshotID := a.archivedSnapshot()
+	if snapshotID == "" && a.runHooks(ctx, PreArchiveStage) {
+		return fmt.Errorf("archive vetoed by a failing %s hook", PreArchiveStage)
+	}
+
+	lockID := ddb.ProfileLockID(a.profile)
+	if err := a.Locker.AcquireLock(ctx, lockID); err != nil {
+		return fmt.Errorf("failed to acquire lock for profile %s: %w", a.profile, err)
+	}
+	a.Logger.Printf("Acquired lock for profile %s", a.profile)
+
+	// Snapshots of large volumes take longer than the lock TTL. The lock is held until the
+	// instance is gone, so nothing restores the profile while it is still running.
+	lease := a.Locker.KeepAlive(ctx, lockID)
+	defer func() {
+		if lease.Stop() != nil {
+			return
+		}
+		if err := a.Locker.ReleaseLock(context.WithoutCancel(ctx), lockID); err != nil {
+			a.Logger.Printf("Failed to release lock for profile %s: %v", a.profile, err)
+		}
+	}()
+
+	if snapshotID == "" {
+		a.recordState(ctx, ddb.StateArchiving, ddb.RecordUpdate{InstanceID: a.instanceID})
+
+		var err error
+		snapshotID, err = a.Archiver.Archive(lease.Context(), a.instanceID, a.profile, reason)
+		if err == nil && lease.Err() != nil {
+			err = fmt.Errorf("lock for profile %s was lost during the archive, not terminating: %w", a.profile, lease.Err())
+		}
+		if err != nil {
+			a.recordState(context.WithoutCancel(ctx), ddb.StateRunning, ddb.RecordUpdate{InstanceID: a.instanceID, Error: err.Error()})
+			return err
+		}
+		a.Logger.Printf("Created snapshot %s for profile %s", snapshotID, a.profile)
+		a.saveArchivedSnapshot(snapshotID)
+	} else {
+		a.Logger.Printf("Instance %s was already archived to snapshot %s", a.instanceID, snapshotID)
+	}
+
+	a.Logger.Printf("Terminating instance %s", a.instanceID)
+	a.saveLastWords(ctx)
+
+	// Recorded before terminating, as the agent may not get to run afterwards
+	a.recordState(ctx, ddb.StateArchived, ddb.RecordUpdate{SnapshotID: snapshotID})
+
+	if err := a.Archiver.Terminate(lease.Context(), a.instanceID); err != nil {
+		a.recordState(context.WithoutCancel(ctx), ddb.StateFailed, ddb.RecordUpdate{InstanceID: a.instanceID, SnapshotID: snapshotID, Error: err.Error()})
+		return err
+	}
+	a.Logger.Printf("Terminated instance %s", a.instanceID)
+	return nil
+}
+
+// archivedSnapshotMarker records the snapshot of this instance so a failed terminate is retried
+// without archiving again
+func (a *Agent) archivedSnapshotMarker() string {
+	return filepath.Join(a.StateDir, fmt.Sprintf("archived-%s", a.instanceID))
+}
+
+// archivedSnapshot returns the snapshot this instance was already archived to, if any
+func (a *Agent) archivedSnapshot() string {
+	data, err := os.ReadFile(a.archivedSnapshotMarker())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveArchivedSnapshot records the snapshot this instance was archived to
+func (a *Agent) saveArchivedSnapshot(snapshotID string) {
+	if err := os.MkdirAll(a.StateDir, 0755); err != nil {
+		a.Logger.Printf("Failed to create state directory %s: %v", a.StateDir, err)
+		return
+	}
+	if err := os.WriteFile(a.archivedSnapshotMarker(), []byte(snapshotID+"\n"), 0644); err != nil {
+		a.Logger.Printf("Failed to write archived snapshot marker: %v", err)
+	}
+}
+
+// recordState moves the profile to a new state in the registry, logging failures
+func (a *Agent) recordState(ctx context.Context, to ddb.ProfileState, update ddb.RecordUpdate) {
+	if a.Registry == nil {
+		return
+	}
+	if err := a.Registry.Transition(ctx, a.profile, to, update); err != nil {
+		a.Logger.Printf("Failed to record state %s for profile %s: %v", to, a.profile, err)
+	}
+}
+
+// saveLastWords copies the recent log lines to the lock table so they outlive the instance
+func (a *Agent) saveLastWords(ctx context.Context) {
+	if a.LogTail == nil {
+		return
+	}
+
+	err := a.State.PutLastWords(ctx, ddb.LastWords{
+		Profile:    a.profile,
+		InstanceID: a.instanceID,
+		WrittenAt:  a.Now(),
+		Lines:      a.LogTail.Lines(),
+	})
+	if err != nil {
+		a.Logger.Printf("Failed to save last words: %v", err)
+	}
+}
+
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if tag.Key != nil && tag.Value != nil && *tag.Key == key {
+			return *tag.Value
+		}
+	}
+	return ""
+}
+
+// retryBackoff doubles the delay after every consecutive archive failure
+func retryBackoff(failures int) time.Duration {
+	delay := archiveRetryBase
+	for i := 1; i < failures && delay < archiveRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > archiveRetryMax {
+		delay = archiveRetryMax
+	}
+	return delay
+}
+
+// archiveReason returns why the instance should be archived now, or an empty string
+func archiveReason(policy ec2utils.Policy, idle, uptime time.Duration, now time.Time) string {
+	timeout := time.Duration(policy.TimeoutSeconds) * time.Second
+	if idle >= timeout {
+		return fmt.Sprintf("No SSH sessions for %s", timeout)
+	}
+
+	if policy.TTL > 0 && uptime >= policy.TTL {
+		return fmt.Sprintf("TTL of %s reached", policy.TTL)
+	}
+
+	// Skip the schedule during the first minute so a box started at that time survives
+	if policy.Schedule != "" && now.UTC().Format("15:04") == policy.Schedule && uptime >= time.Minute {
+		return fmt.Sprintf("Scheduled archive time %s UTC reached", policy.Schedule)
+	}
+
+	return ""
+}
@@ -0,0 +1,519 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+)
+
+type fakeMetadata struct {
+	tags []types.Tag
+}
+
+func (m *fakeMetadata) InstanceID(ctx context.Context) (string, error) {
+	return "i-0123456789abcdef0", nil
+}
+
+func (m *fakeMetadata) Tags(ctx context.Context) ([]types.Tag, error) {
+	return m.tags, nil
+}
+
+type fakeSessions struct {
+	count int
+}
+
+func (s *fakeSessions) ActiveSessions() (int, error) {
+	return s.count, nil
+}
+
+// fakeLocker hands out leases renewed by renewErr, so a test can make the lease get lost
+type fakeLocker struct {
+	renewErr error
+	ttl      time.Duration
+
+	acquired int
+	released int
+}
+
+func (l *fakeLocker) AcquireLock(ctx context.Context, lockID string) error {
+	l.acquired++
+	return nil
+}
+
+func (l *fakeLocker) ReleaseLock(ctx context.Context, lockID string) error {
+	l.released++
+	return nil
+}
+
+func (l *fakeLocker) RenewLock(ctx context.Context, lockID string) error {
+	return l.renewErr
+}
+
+func (l *fakeLocker) KeepAlive(ctx context.Context, lockID string) *ddb.Lease {
+	ttl := l.ttl
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	return ddb.KeepAlive(ctx, l, lockID, ttl)
+}
+
+// fakeArchiver records its calls; with waitForCancel it blocks until its context is canceled and
+// then still reports success, like an archive that finished just as the lease was lost
+type fakeArchiver struct {
+	archiveErr    error
+	terminateErr  error
+	waitForCancel bool
+	locker        *fakeLocker
+
+	archived   int
+	terminated int
+	unlocked   int
+}
+
+func (a *fakeArchiver) Archive(ctx context.Context, instanceID, profile, reason string) (string, error) {
+	a.archived++
+	if a.waitForCancel {
+		<-ctx.Done()
+	}
+	if a.archiveErr != nil {
+		return "", a.archiveErr
+	}
+	return "snap-0123456789abcdef0", nil
+}
+
+func (a *fakeArchiver) Terminate(ctx context.Context, instanceID string) error {
+	a.terminated++
+	if a.locker != nil && a.locker.released >= a.locker.acquired {
+		a.unlocked++
+	}
+	return a.terminateErr
+}
+
+type fakeState struct {
+	mu      sync.Mutex
+	reports []ddb.HookReport
+}
+
+func (s *fakeState) PutHeartbeat(ctx context.Context, hb ddb.Heartbeat) error {
+	return nil
+}
+
+func (s *fakeState) PutHookReport(ctx context.Context, report ddb.HookReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *fakeState) PutLastWords(ctx context.Context, lw ddb.LastWords) error {
+	return nil
+}
+
+type fakeRegistry struct {
+	states []ddb.ProfileState
+}
+
+func (r *fakeRegistry) Transition(ctx context.Context, profile string, to ddb.ProfileState, update ddb.RecordUpdate) error {
+	r.states = append(r.states, to)
+	return nil
+}
+
+type fakeHooks struct {
+	results map[string][]ddb.HookResult
+}
+
+func (h *fakeHooks) RunHooks(ctx context.Context, stage string, env []string) ([]ddb.HookResult, error) {
+	return h.results[stage], nil
+}
+
+type testAgent struct {
+	*Agent
+	sessions *fakeSessions
+	locker   *fakeLocker
+	archiver *fakeArchiver
+	registry *fakeRegistry
+	hooks    *fakeHooks
+	now      time.Time
+}
+
+// newTestAgent returns an agent for profile "dev" with a 60 second idle timeout whose clock only
+// moves when the test advances it
+func newTestAgent(t *testing.T, extraTags ...types.Tag) *testAgent {
+	t.Helper()
+
+	tags := append([]types.Tag{
+		{Key: aws.String("Name"), Value: aws.String("dev")},
+		{Key: aws.String(ec2utils.TimeoutSecondsTag), Value: aws.String("60")},
+	}, extraTags...)
+
+	ta := &testAgent{
+		sessions: &fakeSessions{},
+		locker:   &fakeLocker{},
+		archiver: &fakeArchiver{},
+		registry: &fakeRegistry{},
+		hooks:    &fakeHooks{results: map[string][]ddb.HookResult{}},
+		now:      time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	ta.Agent = &Agent{
+		Metadata:              &fakeMetadata{tags: tags},
+		Sessions:              ta.sessions,
+		Locker:                ta.locker,
+		Archiver:              ta.archiver,
+		State:                 &fakeState{},
+		Registry:              ta.registry,
+		Hooks:                 ta.hooks,
+		Logger:                log.New(io.Discard, "", 0),
+		PollInterval:          time.Second,
+		PolicyReloadInterval:  time.Hour,
+		HeartbeatInterval:     time.Hour,
+		DefaultTimeoutSeconds: ec2utils.DefaultTimeoutSeconds,
+		StateDir:              t.TempDir(),
+		Now:                   func() time.Time { return ta.now },
+		Uptime:                func() (time.Duration, error) { return time.Hour, nil },
+	}
+
+	ta.archiver.locker = ta.locker
+
+	ctx := context.Background()
+	instanceID, _ := ta.Metadata.InstanceID(ctx)
+	ta.instanceID = instanceID
+	ta.idleSince = ta.now
+	ta.applyTags(tags)
+	return ta
+}
+
+func (ta *testAgent) advance(d time.Duration) {
+	ta.now = ta.now.Add(d)
+}
+
+func TestIdleTimeoutArchivesAndTerminates(t *testing.T) {
+	ta := newTestAgent(t)
+	ctx := context.Background()
+
+	ta.advance(30 * time.Second)
+	if ta.tick(ctx) {
+		t.Fatal("tick terminated the instance before the idle timeout")
+	}
+	if ta.archiver.archived != 0 {
+		t.Fatalf("archived %d times before the idle timeout", ta.archiver.archived)
+	}
+
+	ta.advance(30 * time.Second)
+	if !ta.tick(ctx) {
+		t.Fatal("tick did not terminate the instance after the idle timeout")
+	}
+	if ta.archiver.archived != 1 || ta.archiver.terminated != 1 {
+		t.Fatalf("archived %d and terminated %d times, want 1 and 1", ta.archiver.archived, ta.archiver.terminated)
+	}
+	if ta.locker.acquired != 1 || ta.locker.released != 1 {
+		t.Fatalf("acquired %d and released %d locks, want 1 and 1", ta.locker.acquired, ta.locker.released)
+	}
+	want := []ddb.ProfileState{ddb.StateArchiving, ddb.StateArchived}
+	if !reflect.DeepEqual(ta.registry.states, want) {
+		t.Fatalf("recorded states %v, want %v", ta.registry.states, want)
+	}
+}
+
+func TestActiveSessionResetsIdleTime(t *testing.T) {
+	ta := newTestAgent(t)
+	ctx := context.Background()
+
+	ta.sessions.count = 1
+	ta.advance(50 * time.Second)
+	ta.tick(ctx)
+
+	ta.sessions.count = 0
+	ta.advance(50 * time.Second)
+	if ta.tick(ctx) || ta.archiver.archived != 0 {
+		t.Fatal("archived although a session ended less than the idle timeout ago")
+	}
+}
+
+func TestNonPositiveTimeoutTagFallsBackToDefault(t *testing.T) {
+	ta := newTestAgent(t)
+	ta.applyTags([]types.Tag{
+		{Key: aws.String("Name"), Value: aws.String("dev")},
+		{Key: aws.String(ec2utils.TimeoutSecondsTag), Value: aws.String("0")},
+	})
+	ctx := context.Background()
+
+	ta.advance(time.Second)
+	if ta.tick(ctx) || ta.archiver.archived != 0 {
+		t.Fatal("a zero timeout tag archived the instance on the first tick")
+	}
+	if ta.policy.TimeoutSeconds != ec2utils.DefaultTimeoutSeconds {
+		t.Fatalf("timeout is %d, want the default %d", ta.policy.TimeoutSeconds, ec2utils.DefaultTimeoutSeconds)
+	}
+}
+
+func TestPinnedProfileSkipsArchive(t *testing.T) {
+	ta := newTestAgent(t, types.Tag{Key: aws.String(ec2utils.PinnedTag), Value: aws.String("true")})
+	ctx := context.Background()
+
+	ta.advance(10 * time.Minute)
+	if ta.tick(ctx) {
+		t.Fatal("tick terminated a pinned instance")
+	}
+	if ta.archiver.archived != 0 || ta.locker.acquired != 0 {
+		t.Fatalf("pinned instance was archived %d times with %d locks", ta.archiver.archived, ta.locker.acquired)
+	}
+}
+
+func TestExpiredPinArchives(t *testing.T) {
+	until := time.Date(2025, 1, 1, 12, 5, 0, 0, time.UTC)
+	ta := newTestAgent(t,
+		types.Tag{Key: aws.String(ec2utils.PinnedTag), Value: aws.String("true")},
+		types.Tag{Key: aws.String(ec2utils.PinnedUntilTag), Value: aws.String(until.Format(time.RFC3339))},
+	)
+	ctx := context.Background()
+
+	ta.advance(10 * time.Minute)
+	if !ta.tick(ctx) {
+		t.Fatal("tick did not archive after the pin expired")
+	}
+}
+
+func TestPreArchiveHookFailureVetoesArchive(t *testing.T) {
+	ta := newTestAgent(t)
+	ta.hooks.results[PreArchiveStage] = []ddb.HookResult{
+		{Name: "10-flush", ExitCode: 0},
+		{Name: "20-check", ExitCode: 3, Error: "build still running"},
+	}
+	ctx := context.Background()
+
+	ta.advance(time.Minute)
+	if ta.tick(ctx) {
+		t.Fatal("tick terminated the instance although a pre-archive hook failed")
+	}
+	if ta.archiver.archived != 0 || ta.locker.acquired != 0 {
+		t.Fatalf("vetoed archive still ran: archived %d, locks %d", ta.archiver.archived, ta.locker.acquired)
+	}
+	if !strings.Contains(ta.lastError, "vetoed") {
+		t.Fatalf("last error %q does not mention the veto", ta.lastError)
+	}
+
+	reports := ta.State.(*fakeState).reports
+	if len(reports) != 1 || reports[0].Stage != PreArchiveStage || len(reports[0].Results) != 2 {
+		t.Fatalf("hook report not recorded: %+v", reports)
+	}
+}
+
+func TestLostLeaseDoesNotTerminate(t *testing.T) {
+	ta := newTestAgent(t)
+	ta.locker.renewErr = ddb.ErrLockNotOwned
+	ta.locker.ttl = 30 * time.Millisecond
+	ta.archiver.waitForCancel = true
+	ctx := context.Background()
+
+	ta.advance(time.Minute)
+	if ta.tick(ctx) {
+		t.Fatal("tick terminated the instance after losing the lock")
+	}
+	if ta.archiver.archived != 1 {
+		t.Fatalf("archived %d times, want 1", ta.archiver.archived)
+	}
+	if ta.archiver.terminated != 0 {
+		t.Fatal("terminated the instance after losing the lock")
+	}
+	if ta.locker.released != 0 {
+		t.Fatal("released a lock that is no longer ours")
+	}
+	if !strings.Contains(ta.lastError, "lost") {
+		t.Fatalf("last error %q does not mention the lost lock", ta.lastError)
+	}
+	if last := ta.registry.states[len(ta.registry.states)-1]; last != ddb.StateRunning {
+		t.Fatalf("recorded %s after the failed archive, want %s", last, ddb.StateRunning)
+	}
+}
+
+func TestArchiveFailureRetriesWithBackoff(t *testing.T) {
+	ta := newTestAgent(t)
+	ta.archiver.archiveErr = errors.New("snapshot quota exceeded")
+	ctx := context.Background()
+
+	ta.advance(time.Minute)
+	ta.tick(ctx)
+	if ta.archiver.archived != 1 || ta.failures != 1 {
+		t.Fatalf("archived %d times with %d failures, want 1 and 1", ta.archiver.archived, ta.failures)
+	}
+
+	// Within the first backoff nothing is retried
+	ta.advance(archiveRetryBase / 2)
+	ta.tick(ctx)
+	if ta.archiver.archived != 1 {
+		t.Fatalf("retried after %s, before the backoff of %s", archiveRetryBase/2, archiveRetryBase)
+	}
+
+	ta.advance(archiveRetryBase / 2)
+	ta.tick(ctx)
+	if ta.archiver.archived != 2 || ta.failures != 2 {
+		t.Fatalf("archived %d times with %d failures after the backoff, want 2 and 2", ta.archiver.archived, ta.failures)
+	}
+	if got := ta.retryAt.Sub(ta.now); got != 2*archiveRetryBase {
+		t.Fatalf("second backoff is %s, want %s", got, 2*archiveRetryBase)
+	}
+	if ta.archiver.terminated != 0 {
+		t.Fatal("terminated the instance after a failed archive")
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, archiveRetryMax},
+		{20, archiveRetryMax},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.failures); got != tt.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	tests := map[string]string{
+		"":                         "",
+		"single":                   "single",
+		"first\nsecond\n":          "second",
+		"first\nlast line\n\n\n":   "last line",
+		"  padded output  \n  ":    "padded output",
+		"one\ntwo\nthree\nfailed!": "failed!",
+	}
+	for output, want := range tests {
+		if got := lastLine(output); got != want {
+			t.Errorf("lastLine(%q) = %q, want %q", output, got, want)
+		}
+	}
+}
+
+// writeHook writes a shell script hook into dir with the given mode
+func writeHook(t *testing.T, dir, name, script string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirHookRunnerOrderAndExecBit(t *testing.T) {
+	root := t.TempDir()
+	stageDir := filepath.Join(root, PreArchiveStage)
+	if err := os.Mkdir(stageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	trace := filepath.Join(root, "trace")
+
+	writeHook(t, stageDir, "20-second", `echo second >> "$TRACE"`, 0755)
+	writeHook(t, stageDir, "10-first", `echo "first $DUMIE_PROFILE $DUMIE_HOOK_STAGE" >> "$TRACE"`, 0755)
+	writeHook(t, stageDir, "15-disabled", `echo disabled >> "$TRACE"`, 0644)
+	writeHook(t, stageDir, "30-fails", "echo working\necho 'disk busy' >&2\nexit 4", 0755)
+	if err := os.Mkdir(filepath.Join(stageDir, "40-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &DirHookRunner{Dir: root, Timeout: 10 * time.Second}
+	results, err := runner.RunHooks(context.Background(), PreArchiveStage, []string{"DUMIE_PROFILE=dev", "TRACE=" + trace})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Name)
+	}
+	if want := []string{"10-first", "20-second", "30-fails"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ran hooks %v, want %v", names, want)
+	}
+
+	data, err := os.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "first dev pre-archive\nsecond\n"; got != want {
+		t.Fatalf("hooks wrote %q, want %q", got, want)
+	}
+
+	if results[0].Failed() || results[1].Failed() {
+		t.Fatalf("successful hooks reported as failed: %+v", results[:2])
+	}
+	if results[2].ExitCode != 4 || results[2].Error != "disk busy" {
+		t.Fatalf("failing hook reported %d %q, want 4 %q", results[2].ExitCode, results[2].Error, "disk busy")
+	}
+}
+
+func TestDirHookRunnerTimeout(t *testing.T) {
+	root := t.TempDir()
+	stageDir := filepath.Join(root, PostRestoreStage)
+	if err := os.Mkdir(stageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeHook(t, stageDir, "10-slow", "exec sleep 10", 0755)
+
+	runner := &DirHookRunner{Dir: root, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	results, err := runner.RunHooks(context.Background(), PostRestoreStage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("timed out hook ran for %s", elapsed)
+	}
+	if len(results) != 1 || results[0].ExitCode != -1 || !strings.Contains(results[0].Error, "timed out") {
+		t.Fatalf("slow hook reported %+v, want a timeout", results)
+	}
+}
+
+func TestDirHookRunnerMissingStage(t *testing.T) {
+	runner := &DirHookRunner{Dir: t.TempDir(), Timeout: time.Second}
+	results, err := runner.RunHooks(context.Background(), PreArchiveStage, nil)
+	if err != nil || results != nil {
+		t.Fatalf("missing stage directory returned %v, %v; want no hooks and no error", results, err)
+	}
+}
+
+func TestFailedTerminateRetriesWithoutArchiving(t *testing.T) {
+	ta := newTestAgent(t)
+	ta.archiver.terminateErr = errors.New("request limit exceeded")
+	ctx := context.Background()
+
+	ta.advance(time.Minute)
+	if ta.tick(ctx) {
+		t.Fatal("tick reported a termination that failed")
+	}
+	if ta.archiver.archived != 1 || ta.archiver.terminated != 1 {
+		t.Fatalf("archived %d and terminated %d times, want 1 and 1", ta.archiver.archived, ta.archiver.terminated)
+	}
+
+	ta.archiver.terminateErr = nil
+	ta.advance(archiveRetryBase)
+	if !ta.tick(ctx) {
+		t.Fatal("retry did not terminate the instance")
+	}
+	if ta.archiver.archived != 1 {
+		t.Fatalf("archived %d times, want the retry to only terminate", ta.archiver.archived)
+	}
+	if ta.archiver.unlocked != 0 {
+		t.Fatalf("terminated %d time(s) without holding the profile lock", ta.archiver.unlocked)
+	}
+	if ta.locker.released != ta.locker.acquired {
+		t.Fatalf("released %d of %d locks", ta.locker.released, ta.locker.acquired)
+	}
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
+)
+
+const (
+	// DefaultHooksDir holds one sub-directory of executable hooks per stage
+	DefaultHooksDir = "/etc/dumie/hooks.d"
+
+	// DefaultHookTimeout bounds how long a single hook may run
+	DefaultHookTimeout = 5 * time.Minute
+
+	// PreArchiveStage hooks run before the instance is archived; any failure vetoes the archive
+	PreArchiveStage = "pre-archive"
+
+	// PostRestoreStage hooks run once on the first boot of an instance restored from a snapshot
+	PostRestoreStage = "post-restore"
+)
+
+// HookRunner runs the hooks of a stage
+type HookRunner interface {
+	RunHooks(ctx context.Context, stage string, env []string) ([]ddb.HookResult, error)
+}
+
+// DirHookRunner runs the executable files in <Dir>/<stage> in lexical order
+type DirHookRunner struct {
+	Dir     string
+	Timeout time.Duration
+}
+
+func (r *DirHookRunner) RunHooks(ctx context.Context, stage string, env []string) ([]ddb.HookResult, error) {
+	stageDir := filepath.Join(r.Dir, stage)
+	entries, err := os.ReadDir(stageDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hook directory %s: %w", stageDir, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var results []ddb.HookResult
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+		results = append(results, r.runHook(ctx, filepath.Join(stageDir, entry.Name()), stage, env))
+	}
+
+	return results, nil
+}
+
+func (r *DirHookRunner) runHook(ctx context.Context, path, stage string, env []string) ddb.HookResult {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(append(os.Environ(), env...), "DUMIE_HOOK_STAGE="+stage)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+	result := ddb.HookResult{
+		Name:     filepath.Base(path),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("timed out after %s", r.Timeout)
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+		result.Error = lastLine(output.String())
+	case err != nil:
+		result.ExitCode = -1
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// lastLine keeps the tail of a hook's output as its error summary
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
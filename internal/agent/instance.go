@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ec2utils "github.com/dumie-org/dumie-cli/internal/aws/ec2"
+)
+
+// IMDSMetadata reads instance metadata and tags through IMDSv2
+type IMDSMetadata struct {
+	Client *imds.Client
+}
+
+func NewIMDSMetadata(cfg aws.Config) *IMDSMetadata {
+	return &IMDSMetadata{Client: imds.NewFromConfig(cfg)}
+}
+
+func (m *IMDSMetadata) get(ctx context.Context, path string) (string, error) {
+	output, err := m.Client.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", fmt.Errorf("failed to get metadata %s: %w", path, err)
+	}
+	defer output.Content.Close()
+
+	data, err := io.ReadAll(output.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (m *IMDSMetadata) InstanceID(ctx context.Context) (string, error) {
+	return m.get(ctx, "instance-id")
+}
+
+// Tags requires instance metadata tags to be enabled on the instance
+func (m *IMDSMetadata) Tags(ctx context.Context) ([]types.Tag, error) {
+	keys, err := m.get(ctx, "tags/instance")
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []types.Tag
+	for _, key := range strings.Split(keys, "\n") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		value, err := m.get(ctx, "tags/instance/"+key)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return tags, nil
+}
+
+// WhoSessionCounter counts interactive SSH sessions through who(1)
+type WhoSessionCounter struct{}
+
+func (c *WhoSessionCounter) ActiveSessions() (int, error) {
+	output, err := exec.Command("who").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run who: %w", err)
+	}
+	return bytes.Count(output, []byte("pts/")), nil
+}
+
+// SSHSessionCounter counts interactive sessions through who(1) and sessions without a terminal, such
+// as the tunnels of dumie forward, through the established TCP connections to the SSH port. Each
+// connection usually carries one session, so the larger count wins.
+type SSHSessionCounter struct {
+	Who WhoSessionCounter
+
+	// ProcFiles are the kernel TCP tables to read, /proc/net/tcp and /proc/net/tcp6 if empty
+	ProcFiles []string
+}
+
+func (c *SSHSessionCounter) ActiveSessions() (int, error) {
+	terminals, err := c.Who.ActiveSessions()
+	if err != nil {
+		return 0, err
+	}
+
+	files := c.ProcFiles
+	if len(files) == 0 {
+		files = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+	}
+	connections := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			// tcp6 is missing when IPv6 is disabled
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		connections += countEstablished(string(data), 22)
+	}
+
+	return max(terminals, connections), nil
+}
+
+// countEstablished counts the established connections to a local port in a /proc/net/tcp table
+func countEstablished(table string, port int) int {
+	const established = "01"
+
+	count := 0
+	for _, line := range strings.Split(table, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != established {
+			continue
+		}
+		// The local address is hex IP:port
+		_, localPort, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		if p, err := strconv.ParseInt(localPort, 16, 32); err == nil && int(p) == port {
+			count++
+		}
+	}
+	return count
+}
+
+// ReadUptime returns the time since the instance booted
+func ReadUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read /proc/uptime: %w", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected /proc/uptime content %q", data)
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse uptime: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// EC2Archiver archives the instance with the same pipeline as dumie delete
+type EC2Archiver struct {
+	Client *ec2.Client
+	Logger *log.Logger
+}
+
+func (a *EC2Archiver) Archive(ctx context.Context, instanceID, profile, reason string) (string, error) {
+	return ec2utils.Archive(ctx, a.Client, ec2utils.ArchiveOptions{
+		Profile:    profile,
+		InstanceID: instanceID,
+		Source:     ec2utils.ArchiveSourceAgent,
+		Reason:     reason,
+		Logger:     a.Logger,
+	})
+}
+
+func (a *EC2Archiver) Terminate(ctx context.Context, instanceID string) error {
+	return ec2utils.TerminateInstance(ctx, a.Client, instanceID)
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultLogBufferLines is how many recent log lines the agent keeps for its last words
+const DefaultLogBufferLines = 50
+
+// LogBuffer is an io.Writer that keeps the most recent complete log lines in memory
+type LogBuffer struct {
+	mu      sync.Mutex
+	size    int
+	lines   []string
+	partial string
+}
+
+func NewLogBuffer(size int) *LogBuffer {
+	return &LogBuffer{size: size}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data := b.partial + string(p)
+	parts := strings.Split(data, "\n")
+	b.partial = parts[len(parts)-1]
+
+	for _, line := range parts[:len(parts)-1] {
+		b.lines = append(b.lines, line)
+	}
+	if len(b.lines) > b.size {
+		b.lines = b.lines[len(b.lines)-b.size:]
+	}
+
+	return len(p), nil
+}
+
+// Lines returns a copy of the buffered lines, oldest first
+func (b *LogBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.lines...)
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
@@ -16,3 +18,22 @@ func GetDynamoDBAWSClient() (*dynamodb.Client, error) {
 
 	return dynamodb.NewFromConfig(cfg), nil
 }
+
+// GetInstanceAWSConfig loads the SDK config on a Dumie instance, using the instance role
+// credentials and the region reported by the instance metadata service. The region always comes
+// from the metadata service, so an AWS_REGION left in the environment of a migrated instance
+// cannot point the agent at the region it was migrated from.
+func GetInstanceAWSConfig(ctx context.Context) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+
+	region, err := imds.NewFromConfig(cfg).GetRegion(ctx, &imds.GetRegionInput{})
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to get region from instance metadata: %w", err)
+	}
+	cfg.Region = region.Region
+
+	return cfg, nil
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -22,6 +23,44 @@ type AWSConfig struct {
 	SecretAccessKey string `json:"aws_secret_access_key"`
 	Region          string `json:"aws_region"`
 	KeyPairName     string `json:"key_pair_name"`
+
+	// UserDataTemplate is an optional path to a user data template replacing the embedded one
+	UserDataTemplate string `json:"user_data_template,omitempty"`
+
+	// Encryption is the volume encryption of profiles without their own setting:
+	// "none", "default" for the account's default KMS key, or a KMS key ID, alias or ARN
+	Encryption string `json:"encryption,omitempty"`
+
+	// ProfileRegions maps profiles that were migrated away from Region to the region they live in
+	ProfileRegions map[string]string `json:"profile_regions,omitempty"`
+
+	// LockTable is the DynamoDB table holding locks and profile state, DefaultLockTable if empty
+	LockTable string `json:"lock_table,omitempty"`
+
+	// IPEndpoint is the URL that reports the public IP SSH access is granted to, DefaultIPEndpoint if empty
+	IPEndpoint string `json:"ip_endpoint,omitempty"`
+
+	// AllowedIP overrides the detected public IP with a fixed address or CIDR block
+	AllowedIP string `json:"allowed_ip,omitempty"`
+
+	// IPRuleMaxAgeDays is how many days SSH rules that were not refreshed are kept
+	IPRuleMaxAgeDays int `json:"ip_rule_max_age_days,omitempty"`
+}
+
+// LockTableName returns the configured lock table
+func (c *AWSConfig) LockTableName() string {
+	if c.LockTable != "" {
+		return c.LockTable
+	}
+	return DefaultLockTable
+}
+
+// RegionFor returns the region a profile lives in
+func (c *AWSConfig) RegionFor(profile string) string {
+	if region, ok := c.ProfileRegions[profile]; ok && region != "" {
+		return region
+	}
+	return c.Region
 }
 
 const (
@@ -36,6 +75,12 @@ const (
 
 	// ConfigFilePath is the path to the config file
 	ConfigFilePath = "aws_config.json"
+
+	// KnownHostsDir holds the pinned SSH host keys of each profile
+	KnownHostsDir = "known_hosts"
+
+	// DefaultLockTable is the DynamoDB table holding Dumie locks unless another one is configured
+	DefaultLockTable = "dumie-lock-table"
 )
 
 // LoadAWSConfig loads the AWS configuration from the config file
@@ -55,12 +100,22 @@ func LoadAWSConfig() (*AWSConfig, error) {
 	return &config, nil
 }
 
-func GetEC2AWSClient() (*ec2.Client, error) {
-	cfgData, err := LoadAWSConfig()
+// SaveAWSConfig writes the configuration back to the config file
+func SaveAWSConfig(cfg *AWSConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error marshaling config: %w", err)
 	}
 
+	if err := os.WriteFile(ConfigFilePath, data, 0644); err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+
+	return nil
+}
+
+// loadSDKConfig builds an SDK config from the configured credentials for a region
+func loadSDKConfig(cfgData *AWSConfig, region string) (aws.Config, error) {
 	awsCfg, err := config.LoadDefaultConfig(
 		context.TODO(),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
@@ -68,10 +123,40 @@ func GetEC2AWSClient() (*ec2.Client, error) {
 			cfgData.SecretAccessKey,
 			"",
 		)),
-		config.WithRegion(cfgData.Region),
+		config.WithRegion(region),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+		return aws.Config{}, fmt.Errorf("unable to load AWS SDK config: %w", err)
+	}
+	return awsCfg, nil
+}
+
+func GetEC2AWSClient() (*ec2.Client, error) {
+	return GetEC2ClientForRegion("")
+}
+
+// GetEC2ClientForProfile returns an EC2 client for the region the profile lives in
+func GetEC2ClientForProfile(profile string) (*ec2.Client, error) {
+	cfgData, err := LoadAWSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return GetEC2ClientForRegion(cfgData.RegionFor(profile))
+}
+
+// GetEC2ClientForRegion returns an EC2 client for a region, or for the configured region if empty
+func GetEC2ClientForRegion(region string) (*ec2.Client, error) {
+	cfgData, err := LoadAWSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = cfgData.Region
+	}
+
+	awsCfg, err := loadSDKConfig(cfgData, region)
+	if err != nil {
+		return nil, err
 	}
 
 	client := ec2.NewFromConfig(awsCfg)
@@ -80,22 +165,31 @@ func GetEC2AWSClient() (*ec2.Client, error) {
 }
 
 func GetDynamoDBClient() (*dynamodb.Client, error) {
+	return GetDynamoDBClientForRegion("")
+}
+
+// GetDynamoDBClientForProfile returns a DynamoDB client for the region the profile lives in
+func GetDynamoDBClientForProfile(profile string) (*dynamodb.Client, error) {
 	cfgData, err := LoadAWSConfig()
 	if err != nil {
 		return nil, err
 	}
+	return GetDynamoDBClientForRegion(cfgData.RegionFor(profile))
+}
 
-	awsCfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			cfgData.AccessKeyID,
-			cfgData.SecretAccessKey,
-			"",
-		)),
-		config.WithRegion(cfgData.Region),
-	)
+// GetDynamoDBClientForRegion returns a DynamoDB client for a region, or for the configured region if empty
+func GetDynamoDBClientForRegion(region string) (*dynamodb.Client, error) {
+	cfgData, err := LoadAWSConfig()
 	if err != nil {
-		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+		return nil, err
+	}
+	if region == "" {
+		region = cfgData.Region
+	}
+
+	awsCfg, err := loadSDKConfig(cfgData, region)
+	if err != nil {
+		return nil, err
 	}
 
 	client := dynamodb.NewFromConfig(awsCfg)
@@ -109,17 +203,9 @@ func GetIAMClient() (*iam.Client, error) {
 		return nil, err
 	}
 
-	awsCfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-			cfgData.AccessKeyID,
-			cfgData.SecretAccessKey,
-			"",
-		)),
-		config.WithRegion(cfgData.Region),
-	)
+	awsCfg, err := loadSDKConfig(cfgData, cfgData.Region)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load AWS SDK config: %w", err)
+		return nil, err
 	}
 
 	client := iam.NewFromConfig(awsCfg)
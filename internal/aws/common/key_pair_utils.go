@@ -2,15 +2,18 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 )
 
 func generateKeyPairName() string {
@@ -64,3 +67,39 @@ func GetKeyPairName() (string, error) {
 	}
 	return config.KeyPairName, nil
 }
+
+// EnsureKeyPairInRegion imports the configured key pair into the region of the client if it is
+// missing there, deriving the public key from the local private key file
+func EnsureKeyPairInRegion(ctx context.Context, client *ec2.Client, keyName string) error {
+	_, err := client.DescribeKeyPairs(ctx, &ec2.DescribeKeyPairsInput{
+		KeyNames: []string{keyName},
+	})
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "InvalidKeyPair.NotFound" {
+		return fmt.Errorf("failed to describe key pair %s: %w", keyName, err)
+	}
+
+	privateKeyPath := filepath.Join(".", fmt.Sprintf("%s.pem", keyName))
+	data, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read private key %s: %w", privateKeyPath, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse private key %s: %w", privateKeyPath, err)
+	}
+
+	_, err = client.ImportKeyPair(ctx, &ec2.ImportKeyPairInput{
+		KeyName:           aws.String(keyName),
+		PublicKeyMaterial: ssh.MarshalAuthorizedKey(signer.PublicKey()),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import key pair %s: %w", keyName, err)
+	}
+
+	return nil
+}
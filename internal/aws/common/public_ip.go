@@ -0,0 +1,97 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultIPEndpoint answers with the public IP address of the caller as plain text
+	DefaultIPEndpoint = "https://checkip.amazonaws.com"
+
+	// DefaultIPRuleMaxAgeDays is how long an SSH rule of a user who stopped connecting is kept
+	DefaultIPRuleMaxAgeDays = 30
+
+	ipDetectionTimeout = 10 * time.Second
+)
+
+// IPEndpointURL returns the configured public IP detection endpoint
+func (c *AWSConfig) IPEndpointURL() string {
+	if c.IPEndpoint != "" {
+		return c.IPEndpoint
+	}
+	return DefaultIPEndpoint
+}
+
+// IPRuleMaxAge returns how long SSH rules are kept after they were last refreshed
+func (c *AWSConfig) IPRuleMaxAge() time.Duration {
+	days := c.IPRuleMaxAgeDays
+	if days <= 0 {
+		days = DefaultIPRuleMaxAgeDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// CallerCIDR returns the address range SSH access is granted to: the configured AllowedIP if set,
+// otherwise the public IP reported by the detection endpoint as a /32 or /128
+func CallerCIDR(ctx context.Context, cfg *AWSConfig) (string, error) {
+	if cfg.AllowedIP != "" {
+		return ParseCIDR(cfg.AllowedIP)
+	}
+
+	ip, err := DetectPublicIP(ctx, cfg.IPEndpointURL())
+	if err != nil {
+		return "", err
+	}
+	return ParseCIDR(ip)
+}
+
+// ParseCIDR accepts an IP address or CIDR block and returns it as a CIDR block
+func ParseCIDR(value string) (string, error) {
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network.String(), nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", value)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// DetectPublicIP asks an endpoint that echoes the caller's address for the public IP
+func DetectPublicIP(ctx context.Context, endpoint string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ipDetectionTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP detection endpoint %s: %w", endpoint, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect public IP from %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to detect public IP from %s: %s", endpoint, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("failed to read public IP from %s: %w", endpoint, err)
+	}
+
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("%s returned %q, not an IP address", endpoint, ip)
+	}
+	return ip, nil
+}
@@ -56,7 +56,11 @@ func WaitForResourceStatus(ctx context.Context, checker StatusChecker) error {
 			lastStatusUpdate = time.Now()
 		}
 
-		time.Sleep(RetryDelay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for %s %s: %w", checker.GetResourceType(), checker.GetResourceID(), ctx.Err())
+		case <-time.After(RetryDelay):
+		}
 	}
 
 	elapsed := time.Since(startTime)
@@ -118,6 +122,21 @@ func WaitForInstanceStopped(client *ec2.Client, instanceID string) error {
 		})
 }
 
+// WaitForSnapshotCompleted waits until a snapshot reaches the completed state. Snapshots of
+// large volumes take much longer than instance transitions, so the wait is bounded by maxWait.
+func WaitForSnapshotCompleted(ctx context.Context, client *ec2.Client, snapshotID string, maxWait time.Duration) error {
+	waiter := ec2.NewSnapshotCompletedWaiter(client)
+	return waiter.Wait(ctx,
+		&ec2.DescribeSnapshotsInput{
+			SnapshotIds: []string{snapshotID},
+		},
+		maxWait,
+		func(o *ec2.SnapshotCompletedWaiterOptions) {
+			o.MinDelay = 5 * RetryDelay
+			o.MaxDelay = 30 * RetryDelay
+		})
+}
+
 func WaitForInstanceRunningWithStatus(client *ec2.Client, instanceID string) error {
 	if err := WaitForInstanceRunning(client, instanceID); err != nil {
 		return fmt.Errorf("failed to wait for instance running: %v", err)
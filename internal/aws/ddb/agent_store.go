@@ -0,0 +1,39 @@
+package ddb
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AgentStore reads and writes the state the on-instance agent reports, such as
+// heartbeats and hook results, in the lock table
+type AgentStore struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewAgentStore(client *dynamodb.Client) *AgentStore {
+	return &AgentStore{
+		Client:    client,
+		TableName: TableName(),
+	}
+}
+
+func stringAttr(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func numberAttr(item map[string]types.AttributeValue, name string) int64 {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		n, err := strconv.ParseInt(v.Value, 10, 64)
+		if err == nil {
+			return n
+		}
+	}
+	return 0
+}
@@ -7,7 +7,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,24 +21,61 @@ type DynamoDBLock struct {
 	Client    *dynamodb.Client
 	TableName string
 	TTL       time.Duration
+	Owner     Owner
+
+	// Operation is recorded with each lock taken, e.g. "use" or "archive"
+	Operation string
 }
 
+// ErrLockNotOwned is returned when renewing or releasing a lock that another owner holds
+var ErrLockNotOwned = errors.New("lock is not held by this owner")
+
 const (
-	tableName = "dumie-lock-table"
-	ttl       = 5 * time.Minute
+	// DefaultTableName is the DynamoDB table holding Dumie locks unless another one is configured
+	DefaultTableName = common.DefaultLockTable
+
+	// expiresAttribute is the attribute DynamoDB Time to Live deletes items by. Every item that
+	// should go away on its own, such as locks, heartbeats and last words, sets it.
+	expiresAttribute = "Expires"
+
+	// ProfileLockPrefix starts the lock ID of every profile lock
+	ProfileLockPrefix = "profile-"
+
+	// DefaultLockTTL is how long a lock is held unless its lease is renewed
+	DefaultLockTTL = 5 * time.Minute
+
+	// lockRetryBase and lockRetryMax bound the backoff of WaitForLock
+	lockRetryBase = time.Second
+	lockRetryMax  = 30 * time.Second
 )
 
+// TableName returns the lock table set in the config file, or DefaultTableName without one
+func TableName() string {
+	cfg, err := common.LoadAWSConfig()
+	if err != nil {
+		return DefaultTableName
+	}
+	return cfg.LockTableName()
+}
+
 func NewDynamoDBLock(client *dynamodb.Client) *DynamoDBLock {
 	return &DynamoDBLock{
 		Client:    client,
-		TableName: tableName,
-		TTL:       ttl,
+		TableName: TableName(),
+		TTL:       DefaultLockTTL,
+		Owner:     newOwner(),
 	}
 }
 
+// ProfileLockID returns the lock that every operation changing the instance or snapshots
+// of a profile must hold
+func ProfileLockID(profile string) string {
+	return ProfileLockPrefix + profile
+}
+
 func SearchDynamoDBLockTable(client *dynamodb.Client) (bool, error) {
 	_, err := client.DescribeTable(context.Background(), &dynamodb.DescribeTableInput{
-		TableName: aws.String(tableName),
+		TableName: aws.String(TableName()),
 	})
 	if err != nil {
 		if errors.As(err, new(*types.ResourceNotFoundException)) {
@@ -76,86 +114,347 @@ func (lock *DynamoDBLock) CreateLockTable(ctx context.Context) error {
 		return fmt.Errorf("failed waiting for table to become active: %w", err)
 	}
 
+	if err := lock.EnableTTL(ctx); err != nil {
+		return err
+	}
+
 	fmt.Printf("DynamoDB lock table %s created and active.\n", lock.TableName)
 	return nil
 }
 
+// TTLEnabled reports whether DynamoDB Time to Live deletes expired items of the lock table
+func (lock *DynamoDBLock) TTLEnabled(ctx context.Context) (bool, error) {
+	output, err := lock.Client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(lock.TableName),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to describe Time to Live of table %s: %w", lock.TableName, err)
+	}
+
+	desc := output.TimeToLiveDescription
+	if desc == nil || aws.ToString(desc.AttributeName) != expiresAttribute {
+		return false, nil
+	}
+	switch desc.TimeToLiveStatus {
+	case types.TimeToLiveStatusEnabled, types.TimeToLiveStatusEnabling:
+		return true, nil
+	}
+	return false, nil
+}
+
+// EnableTTL has DynamoDB delete items of the lock table once their Expires time has passed,
+// instead of keeping them forever and ignoring them in lock conditions. Items without Expires,
+// such as registry records, are kept.
+func (lock *DynamoDBLock) EnableTTL(ctx context.Context) error {
+	enabled, err := lock.TTLEnabled(ctx)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return nil
+	}
+
+	_, err = lock.Client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(lock.TableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(expiresAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable Time to Live on table %s: %w", lock.TableName, err)
+	}
+
+	fmt.Printf("Enabled Time to Live on %s.%s\n", lock.TableName, expiresAttribute)
+	return nil
+}
+
 func (lock *DynamoDBLock) waitForTableActive(ctx context.Context) error {
 	checker := NewDynamoDBStatusChecker(lock.Client, lock.TableName)
 	return common.WaitForResourceStatus(ctx, checker)
 }
 
+// AcquireLock takes a lock for lock.TTL, or returns an *ErrLockHeld if another owner holds it.
+// Taking a lock this owner already holds extends it.
 func (lock *DynamoDBLock) AcquireLock(ctx context.Context, lockID string) error {
-	isLocked, err := lock.checkLockStatus(ctx, lockID)
+	lock.resolveCallerARN(ctx)
+
+	now := time.Now().Unix()
+	expiration := now + int64(lock.TTL.Seconds())
+
+	item := ownerItem(lock.Owner)
+	item["LockID"] = &types.AttributeValueMemberS{Value: lockID}
+	item["Expires"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiration)}
+	if lock.Operation != "" {
+		item["Operation"] = &types.AttributeValueMemberS{Value: lock.Operation}
+	}
+
+	_, err := lock.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(lock.TableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(LockID) OR Expires < :now OR OwnerToken = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":   &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", now)},
+			":token": &types.AttributeValueMemberS{Value: lock.Owner.Token},
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("failed to check lock status for lockID %s: %w", lockID, err)
+		if errors.As(err, new(*types.ConditionalCheckFailedException)) {
+			return lock.heldError(ctx, lockID)
+		}
+		return fmt.Errorf("failed to acquire lock for lockID %s: %w", lockID, err)
 	}
-	if isLocked {
-		return fmt.Errorf("lock %s is already held", lockID)
+
+	return nil
+}
+
+// WaitForLock takes a lock, retrying with jittered exponential backoff while another owner
+// holds it. It gives up with the last *ErrLockHeld once timeout has passed and returns the
+// context error as soon as ctx is canceled. onWait, if set, is called before each retry.
+func (lock *DynamoDBLock) WaitForLock(ctx context.Context, lockID string, timeout time.Duration, onWait func(held *ErrLockHeld, elapsed time.Duration)) error {
+	start := time.Now()
+	delay := lockRetryBase
+	for {
+		err := lock.AcquireLock(ctx, lockID)
+		var held *ErrLockHeld
+		if err == nil || !errors.As(err, &held) {
+			return err
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= timeout {
+			return err
+		}
+		if onWait != nil {
+			onWait(held, elapsed)
+		}
+
+		// Sleep between half and all of the delay so waiters do not retry in step
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if remaining := timeout - elapsed; wait > remaining {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > lockRetryMax {
+			delay = lockRetryMax
+		}
 	}
+}
 
-	now := time.Now().Unix()
-	expiration := now + int64(lock.TTL.Seconds())
+// RenewLock extends a lock this owner holds by lock.TTL. It fails with ErrLockNotOwned if the
+// lock expired and was taken by someone else or was broken.
+func (lock *DynamoDBLock) RenewLock(ctx context.Context, lockID string) error {
+	expiration := time.Now().Add(lock.TTL).Unix()
 
-	_, err = lock.Client.PutItem(ctx, &dynamodb.PutItemInput{
+	_, err := lock.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(lock.TableName),
-		Item: map[string]types.AttributeValue{
-			"LockID":  &types.AttributeValueMemberS{Value: lockID},
-			"Expires": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiration)},
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: lockID},
 		},
-		ConditionExpression: aws.String("attribute_not_exists(LockID) OR Expires < :now"),
+		UpdateExpression:    aws.String("SET Expires = :expires"),
+		ConditionExpression: aws.String("OwnerToken = :token"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", now)},
+			":expires": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", expiration)},
+			":token":   &types.AttributeValueMemberS{Value: lock.Owner.Token},
 		},
 	})
-
 	if err != nil {
-		return fmt.Errorf("failed to acquire lock for lockID %s: %w", lockID, err)
+		if errors.As(err, new(*types.ConditionalCheckFailedException)) {
+			return fmt.Errorf("failed to renew lock %s: %w", lockID, ErrLockNotOwned)
+		}
+		return fmt.Errorf("failed to renew lock for lockID %s: %w", lockID, err)
 	}
 
 	return nil
 }
 
+// ReleaseLock deletes a lock only if this owner still holds it. It fails with ErrLockNotOwned
+// if the lock expired and was taken by someone else in the meantime.
 func (lock *DynamoDBLock) ReleaseLock(ctx context.Context, lockID string) error {
 	_, err := lock.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(lock.TableName),
 		Key: map[string]types.AttributeValue{
 			"LockID": &types.AttributeValueMemberS{Value: lockID},
 		},
+		ConditionExpression: aws.String("OwnerToken = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: lock.Owner.Token},
+		},
 	})
-
 	if err != nil {
+		if errors.As(err, new(*types.ConditionalCheckFailedException)) {
+			return fmt.Errorf("failed to release lock %s: %w", lockID, ErrLockNotOwned)
+		}
 		return fmt.Errorf("failed to release lock for lockID %s: %w", lockID, err)
 	}
 
 	return nil
 }
 
-func (lock *DynamoDBLock) checkLockStatus(ctx context.Context, lockID string) (bool, error) {
-	output, err := lock.Client.GetItem(ctx, &dynamodb.GetItemInput{
+// heldError describes who holds a lock after a failed attempt to take it
+func (lock *DynamoDBLock) heldError(ctx context.Context, lockID string) error {
+	item, err := lock.getLockItem(ctx, lockID)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		// Released between the attempt and the lookup
+		return &ErrLockHeld{LockID: lockID}
+	}
+	info := lockInfoFromItem(item)
+	return &ErrLockHeld{
+		LockID:    lockID,
+		Owner:     info.Owner,
+		Operation: info.Operation,
+		Expires:   info.Expires,
+	}
+}
+
+// LockInfo describes a profile lock in the lock table
+type LockInfo struct {
+	LockID    string
+	Profile   string
+	Owner     Owner
+	Operation string
+	Expires   time.Time
+}
+
+// Expired reports whether the lock can be taken by anyone
+func (info LockInfo) Expired() bool {
+	return time.Now().After(info.Expires)
+}
+
+func lockInfoFromItem(item map[string]types.AttributeValue) LockInfo {
+	lockID := stringAttr(item, "LockID")
+	return LockInfo{
+		LockID:    lockID,
+		Profile:   strings.TrimPrefix(lockID, ProfileLockPrefix),
+		Owner:     ownerFromItem(item),
+		Operation: stringAttr(item, "Operation"),
+		Expires:   time.Unix(numberAttr(item, "Expires"), 0),
+	}
+}
+
+// ListProfileLocks returns the profile locks in the lock table, including expired ones
+func (lock *DynamoDBLock) ListProfileLocks(ctx context.Context) ([]LockInfo, error) {
+	paginator := dynamodb.NewScanPaginator(lock.Client, &dynamodb.ScanInput{
+		TableName:        aws.String(lock.TableName),
+		FilterExpression: aws.String("begins_with(LockID, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: ProfileLockPrefix},
+		},
+	})
+
+	var locks []LockInfo
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lock table: %w", err)
+		}
+		for _, item := range page.Items {
+			locks = append(locks, lockInfoFromItem(item))
+		}
+	}
+
+	return locks, nil
+}
+
+// GetProfileLock returns the lock of a profile, or nil if nobody holds it
+func (lock *DynamoDBLock) GetProfileLock(ctx context.Context, profile string) (*LockInfo, error) {
+	item, err := lock.getLockItem(ctx, ProfileLockID(profile))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, nil
+	}
+	info := lockInfoFromItem(item)
+	return &info, nil
+}
+
+// BreakLock deletes a stuck lock held by the owner token the caller looked at, so a lock that
+// changed hands in the meantime is kept. The holder finds out on its next renewal or release.
+func (lock *DynamoDBLock) BreakLock(ctx context.Context, lockID, token string) error {
+	_, err := lock.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
 		TableName: aws.String(lock.TableName),
 		Key: map[string]types.AttributeValue{
 			"LockID": &types.AttributeValueMemberS{Value: lockID},
 		},
+		ConditionExpression: aws.String("attribute_not_exists(OwnerToken) OR OwnerToken = :token"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: token},
+		},
 	})
 	if err != nil {
-		return false, fmt.Errorf("failed to check lock status for lockID %s: %w", lockID, err)
+		if errors.As(err, new(*types.ConditionalCheckFailedException)) {
+			return fmt.Errorf("lock %s changed hands, not breaking it", lockID)
+		}
+		return fmt.Errorf("failed to break lock %s: %w", lockID, err)
 	}
 
-	if output.Item == nil {
-		return false, nil
-	}
+	return nil
+}
 
-	now := time.Now().Unix()
-	expires, ok := output.Item["Expires"].(*types.AttributeValueMemberN)
-	if !ok {
-		return false, fmt.Errorf("invalid Expires attribute for lockID %s", lockID)
+// ExpiredItem is a lock table item whose Expires time has passed but that DynamoDB has not
+// removed yet, such as a lock left behind by a crashed client
+type ExpiredItem struct {
+	LockID  string
+	Expires time.Time
+}
+
+// ListExpiredItems returns the items of the lock table whose Expires time has passed
+func (lock *DynamoDBLock) ListExpiredItems(ctx context.Context) ([]ExpiredItem, error) {
+	now := time.Now()
+	paginator := dynamodb.NewScanPaginator(lock.Client, &dynamodb.ScanInput{
+		TableName:            aws.String(lock.TableName),
+		FilterExpression:     aws.String("Expires < :now"),
+		ProjectionExpression: aws.String("LockID, Expires"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", now.Unix())},
+		},
+	})
+
+	var items []ExpiredItem
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lock table: %w", err)
+		}
+		for _, item := range page.Items {
+			items = append(items, ExpiredItem{
+				LockID:  stringAttr(item, "LockID"),
+				Expires: time.Unix(numberAttr(item, "Expires"), 0),
+			})
+		}
 	}
 
-	expirationTime, err := strconv.ParseInt(expires.Value, 10, 64)
+	return items, nil
+}
+
+// DeleteExpiredItem deletes a lock table item only if it is still expired, so an item that
+// was renewed in the meantime is kept
+func (lock *DynamoDBLock) DeleteExpiredItem(ctx context.Context, lockID string) error {
+	_, err := lock.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lock.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: lockID},
+		},
+		ConditionExpression: aws.String("Expires < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", time.Now().Unix())},
+		},
+	})
 	if err != nil {
-		return false, fmt.Errorf("failed to parse Expires attribute for lockID %s: %w", lockID, err)
+		return fmt.Errorf("failed to delete expired item %s: %w", lockID, err)
 	}
 
-	return expirationTime > now, nil
+	return nil
 }
@@ -0,0 +1,104 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// HeartbeatInterval is how often the on-instance agent writes its heartbeat
+	HeartbeatInterval = 30 * time.Second
+
+	// heartbeatStaleAfter is how long a heartbeat stays valid before the agent counts as not running
+	heartbeatStaleAfter = 3 * HeartbeatInterval
+
+	// heartbeatRetention is how long a heartbeat item is kept after it was last written
+	heartbeatRetention = 24 * time.Hour
+)
+
+// Heartbeat is the live state the on-instance agent reports for a profile
+type Heartbeat struct {
+	Profile        string
+	InstanceID     string
+	LastSeen       time.Time
+	ActiveSessions int
+	IdleSeconds    int
+	AgentVersion   string
+
+	// LastError is the most recent archive failure, kept until an archive succeeds
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// Stale reports whether the agent has missed enough heartbeats to be considered not running
+func (hb *Heartbeat) Stale(now time.Time) bool {
+	return now.Sub(hb.LastSeen) > heartbeatStaleAfter
+}
+
+func heartbeatID(profile string) string {
+	return fmt.Sprintf("heartbeat-%s", profile)
+}
+
+func (s *AgentStore) PutHeartbeat(ctx context.Context, hb Heartbeat) error {
+	item := map[string]types.AttributeValue{
+		"LockID":         &types.AttributeValueMemberS{Value: heartbeatID(hb.Profile)},
+		"Profile":        &types.AttributeValueMemberS{Value: hb.Profile},
+		"InstanceID":     &types.AttributeValueMemberS{Value: hb.InstanceID},
+		"LastSeen":       &types.AttributeValueMemberN{Value: strconv.FormatInt(hb.LastSeen.Unix(), 10)},
+		"ActiveSessions": &types.AttributeValueMemberN{Value: strconv.Itoa(hb.ActiveSessions)},
+		"IdleSeconds":    &types.AttributeValueMemberN{Value: strconv.Itoa(hb.IdleSeconds)},
+		"AgentVersion":   &types.AttributeValueMemberS{Value: hb.AgentVersion},
+		"Expires":        &types.AttributeValueMemberN{Value: strconv.FormatInt(hb.LastSeen.Add(heartbeatRetention).Unix(), 10)},
+	}
+	if hb.LastError != "" {
+		item["LastError"] = &types.AttributeValueMemberS{Value: hb.LastError}
+		item["LastErrorAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(hb.LastErrorAt.Unix(), 10)}
+	}
+
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write heartbeat for profile %s: %w", hb.Profile, err)
+	}
+
+	return nil
+}
+
+// GetHeartbeat returns the last heartbeat of a profile, or nil if the agent never reported one
+func (s *AgentStore) GetHeartbeat(ctx context.Context, profile string) (*Heartbeat, error) {
+	output, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: heartbeatID(profile)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get heartbeat for profile %s: %w", profile, err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	hb := &Heartbeat{
+		Profile:      profile,
+		InstanceID:   stringAttr(output.Item, "InstanceID"),
+		AgentVersion: stringAttr(output.Item, "AgentVersion"),
+	}
+	hb.LastSeen = time.Unix(numberAttr(output.Item, "LastSeen"), 0)
+	hb.ActiveSessions = int(numberAttr(output.Item, "ActiveSessions"))
+	hb.IdleSeconds = int(numberAttr(output.Item, "IdleSeconds"))
+	if hb.LastError = stringAttr(output.Item, "LastError"); hb.LastError != "" {
+		hb.LastErrorAt = time.Unix(numberAttr(output.Item, "LastErrorAt"), 0)
+	}
+
+	return hb, nil
+}
@@ -0,0 +1,112 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// hookReportRetention is how long the last hook report of a stage is kept
+const hookReportRetention = 30 * 24 * time.Hour
+
+// HookResult is the outcome of a single hook script
+type HookResult struct {
+	Name     string
+	ExitCode int
+	Error    string
+	Duration time.Duration
+}
+
+// Failed reports whether the hook exited non-zero or could not be run
+func (r HookResult) Failed() bool {
+	return r.ExitCode != 0 || r.Error != ""
+}
+
+// HookReport records the hooks the agent ran for one stage, such as pre-archive
+type HookReport struct {
+	Profile    string
+	InstanceID string
+	Stage      string
+	RanAt      time.Time
+	Results    []HookResult
+}
+
+func hookReportID(profile, stage string) string {
+	return fmt.Sprintf("hooks-%s-%s", stage, profile)
+}
+
+func (s *AgentStore) PutHookReport(ctx context.Context, report HookReport) error {
+	results := make([]types.AttributeValue, 0, len(report.Results))
+	for _, r := range report.Results {
+		results = append(results, &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"Name":       &types.AttributeValueMemberS{Value: r.Name},
+			"ExitCode":   &types.AttributeValueMemberN{Value: strconv.Itoa(r.ExitCode)},
+			"Error":      &types.AttributeValueMemberS{Value: r.Error},
+			"DurationMs": &types.AttributeValueMemberN{Value: strconv.FormatInt(r.Duration.Milliseconds(), 10)},
+		}})
+	}
+
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.TableName),
+		Item: map[string]types.AttributeValue{
+			"LockID":     &types.AttributeValueMemberS{Value: hookReportID(report.Profile, report.Stage)},
+			"Profile":    &types.AttributeValueMemberS{Value: report.Profile},
+			"InstanceID": &types.AttributeValueMemberS{Value: report.InstanceID},
+			"Stage":      &types.AttributeValueMemberS{Value: report.Stage},
+			"RanAt":      &types.AttributeValueMemberN{Value: strconv.FormatInt(report.RanAt.Unix(), 10)},
+			"Results":    &types.AttributeValueMemberL{Value: results},
+			"Expires":    &types.AttributeValueMemberN{Value: strconv.FormatInt(report.RanAt.Add(hookReportRetention).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %s hook report for profile %s: %w", report.Stage, report.Profile, err)
+	}
+
+	return nil
+}
+
+// GetHookReport returns the last hook report of a stage, or nil if none was recorded
+func (s *AgentStore) GetHookReport(ctx context.Context, profile, stage string) (*HookReport, error) {
+	output, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: hookReportID(profile, stage)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s hook report for profile %s: %w", stage, profile, err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	report := &HookReport{
+		Profile:    profile,
+		InstanceID: stringAttr(output.Item, "InstanceID"),
+		Stage:      stage,
+		RanAt:      time.Unix(numberAttr(output.Item, "RanAt"), 0),
+	}
+
+	if list, ok := output.Item["Results"].(*types.AttributeValueMemberL); ok {
+		for _, v := range list.Value {
+			m, ok := v.(*types.AttributeValueMemberM)
+			if !ok {
+				continue
+			}
+			report.Results = append(report.Results, HookResult{
+				Name:     stringAttr(m.Value, "Name"),
+				ExitCode: int(numberAttr(m.Value, "ExitCode")),
+				Error:    stringAttr(m.Value, "Error"),
+				Duration: time.Duration(numberAttr(m.Value, "DurationMs")) * time.Millisecond,
+			})
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,83 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// lastWordsRetention is how long the final agent log of a terminated instance is kept
+const lastWordsRetention = 90 * 24 * time.Hour
+
+// LastWords are the final agent log lines written just before an instance is terminated
+type LastWords struct {
+	Profile    string
+	InstanceID string
+	WrittenAt  time.Time
+	Lines      []string
+}
+
+func lastWordsID(profile string) string {
+	return fmt.Sprintf("lastwords-%s", profile)
+}
+
+func (s *AgentStore) PutLastWords(ctx context.Context, lw LastWords) error {
+	lines := make([]types.AttributeValue, 0, len(lw.Lines))
+	for _, line := range lw.Lines {
+		lines = append(lines, &types.AttributeValueMemberS{Value: line})
+	}
+
+	_, err := s.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.TableName),
+		Item: map[string]types.AttributeValue{
+			"LockID":     &types.AttributeValueMemberS{Value: lastWordsID(lw.Profile)},
+			"Profile":    &types.AttributeValueMemberS{Value: lw.Profile},
+			"InstanceID": &types.AttributeValueMemberS{Value: lw.InstanceID},
+			"WrittenAt":  &types.AttributeValueMemberN{Value: strconv.FormatInt(lw.WrittenAt.Unix(), 10)},
+			"Lines":      &types.AttributeValueMemberL{Value: lines},
+			"Expires":    &types.AttributeValueMemberN{Value: strconv.FormatInt(lw.WrittenAt.Add(lastWordsRetention).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write last words for profile %s: %w", lw.Profile, err)
+	}
+
+	return nil
+}
+
+// GetLastWords returns the final agent log of the last terminated instance of a profile, or nil
+func (s *AgentStore) GetLastWords(ctx context.Context, profile string) (*LastWords, error) {
+	output, err := s.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: lastWordsID(profile)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last words for profile %s: %w", profile, err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+
+	lw := &LastWords{
+		Profile:    profile,
+		InstanceID: stringAttr(output.Item, "InstanceID"),
+		WrittenAt:  time.Unix(numberAttr(output.Item, "WrittenAt"), 0),
+	}
+	if list, ok := output.Item["Lines"].(*types.AttributeValueMemberL); ok {
+		for _, v := range list.Value {
+			if line, ok := v.(*types.AttributeValueMemberS); ok {
+				lw.Lines = append(lw.Lines, line.Value)
+			}
+		}
+	}
+
+	return lw, nil
+}
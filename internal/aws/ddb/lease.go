@@ -0,0 +1,102 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Renewer extends a lock held by its owner
+type Renewer interface {
+	RenewLock(ctx context.Context, lockID string) error
+}
+
+// Lease keeps a lock alive in the background while its holder works. It renews the lock every
+// third of its TTL, so a few failed renewals in a row are tolerated before the lock can expire.
+type Lease struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// KeepAlive starts renewing a lock the caller holds until ctx is canceled or Stop is called.
+// Work that must not continue without the lock should use the lease's Context.
+func KeepAlive(ctx context.Context, renewer Renewer, lockID string, ttl time.Duration) *Lease {
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	lease := &Lease{
+		ctx:    leaseCtx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go lease.run(renewer, lockID, ttl)
+	return lease
+}
+
+// KeepAlive starts renewing a lock this owner holds, see KeepAlive
+func (lock *DynamoDBLock) KeepAlive(ctx context.Context, lockID string) *Lease {
+	return KeepAlive(ctx, lock, lockID, lock.TTL)
+}
+
+func (l *Lease) run(renewer Renewer, lockID string, ttl time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := renewer.RenewLock(l.ctx, lockID)
+		switch {
+		case err == nil:
+			renewed = time.Now()
+			continue
+		case l.ctx.Err() != nil:
+			return
+		case errors.Is(err, ErrLockNotOwned):
+			l.lose(fmt.Errorf("lost lock %s: %w", lockID, err))
+			return
+		case time.Since(renewed) >= ttl:
+			l.lose(fmt.Errorf("lost lock %s, not renewed for %v: %w", lockID, ttl, err))
+			return
+		}
+	}
+}
+
+// lose records why the lease was lost and cancels its context
+func (l *Lease) lose(err error) {
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	l.cancel(err)
+}
+
+// Context is canceled when the lease is lost or stopped
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Err returns why the lease was lost, or nil while it is held
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Stop ends the renewals and returns why the lease was lost, if it was. The lock itself
+// is left to the caller to release.
+func (l *Lease) Stop() error {
+	l.cancel(nil)
+	<-l.done
+	return l.Err()
+}
@@ -0,0 +1,123 @@
+package ddb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/google/uuid"
+)
+
+// Owner identifies the process holding a lock. Token is a random nonce unique to one
+// DynamoDBLock, so a lock is only released or renewed by the process that took it.
+type Owner struct {
+	Token     string
+	Host      string
+	PID       int
+	CallerARN string
+}
+
+// String describes the owner for messages
+func (o Owner) String() string {
+	host := o.Host
+	if host == "" {
+		host = "unknown host"
+	}
+	if o.CallerARN == "" {
+		return fmt.Sprintf("pid %d on %s", o.PID, host)
+	}
+	return fmt.Sprintf("%s (pid %d on %s)", o.CallerARN, o.PID, host)
+}
+
+// newOwner returns the owner of a new lock client. The caller ARN is looked up on first use.
+func newOwner() Owner {
+	host, _ := os.Hostname()
+	return Owner{
+		Token: uuid.NewString(),
+		Host:  host,
+		PID:   os.Getpid(),
+	}
+}
+
+// ErrLockHeld is returned when a lock is held by another owner
+type ErrLockHeld struct {
+	LockID    string
+	Owner     Owner
+	Operation string
+	Expires   time.Time
+}
+
+func (e *ErrLockHeld) Error() string {
+	operation := ""
+	if e.Operation != "" {
+		operation = " for " + e.Operation
+	}
+	return fmt.Sprintf("lock %s is held by %s%s until %s",
+		e.LockID, e.Owner, operation, e.Expires.Local().Format("2006-01-02 15:04:05"))
+}
+
+// ownerItem returns the lock table attributes that record an owner
+func ownerItem(owner Owner) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"OwnerToken": &types.AttributeValueMemberS{Value: owner.Token},
+		"OwnerPID":   &types.AttributeValueMemberN{Value: strconv.Itoa(owner.PID)},
+	}
+	if owner.Host != "" {
+		item["OwnerHost"] = &types.AttributeValueMemberS{Value: owner.Host}
+	}
+	if owner.CallerARN != "" {
+		item["OwnerARN"] = &types.AttributeValueMemberS{Value: owner.CallerARN}
+	}
+	return item
+}
+
+// ownerFromItem reads the owner of a lock table item. Items written before owner tokens
+// were introduced have an empty owner.
+func ownerFromItem(item map[string]types.AttributeValue) Owner {
+	return Owner{
+		Token:     stringAttr(item, "OwnerToken"),
+		Host:      stringAttr(item, "OwnerHost"),
+		PID:       int(numberAttr(item, "OwnerPID")),
+		CallerARN: stringAttr(item, "OwnerARN"),
+	}
+}
+
+// resolveCallerARN fills in the ARN of the AWS identity the lock client uses. Failures are
+// ignored, as the ARN only helps people find out who holds a lock.
+func (lock *DynamoDBLock) resolveCallerARN(ctx context.Context) {
+	if lock.Owner.CallerARN != "" || lock.Client == nil {
+		return
+	}
+	options := lock.Client.Options()
+	client := sts.New(sts.Options{
+		Region:      options.Region,
+		Credentials: options.Credentials,
+		HTTPClient:  options.HTTPClient,
+	})
+	output, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return
+	}
+	lock.Owner.CallerARN = aws.ToString(output.Arn)
+}
+
+// getLockItem reads a lock table item, returning nil if it does not exist
+func (lock *DynamoDBLock) getLockItem(ctx context.Context, lockID string) (map[string]types.AttributeValue, error) {
+	output, err := lock.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(lock.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: lockID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock %s: %w", lockID, err)
+	}
+	return output.Item, nil
+}
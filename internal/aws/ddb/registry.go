@@ -0,0 +1,303 @@
+package ddb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ProfileState is the lifecycle state of a profile in the registry
+type ProfileState string
+
+const (
+	StateCreating  ProfileState = "creating"
+	StateRunning   ProfileState = "running"
+	StateArchiving ProfileState = "archiving"
+	StateArchived  ProfileState = "archived"
+	StateFailed    ProfileState = "failed"
+
+	// registryPrefix starts the ID of every registry item in the lock table
+	registryPrefix = "registry-"
+)
+
+// transitions lists the states a profile may move to a state from. The empty state is a
+// profile the registry does not know yet. Creating may follow creating because callers hold the
+// profile lock, so a profile in creating was left there by a command that crashed.
+var transitions = map[ProfileState][]ProfileState{
+	StateCreating:  {"", StateCreating, StateArchived, StateFailed},
+	StateRunning:   {"", StateCreating, StateRunning, StateArchiving, StateFailed},
+	StateArchiving: {"", StateRunning, StateFailed},
+	StateArchived:  {"", StateArchiving, StateArchived, StateFailed},
+	StateFailed:    {"", StateCreating, StateRunning, StateArchiving, StateArchived, StateFailed},
+}
+
+// Active reports whether a profile in this state has or is about to have an instance
+func (s ProfileState) Active() bool {
+	return s == StateCreating || s == StateRunning || s == StateArchiving
+}
+
+// ProfileRecord is the registry entry of a profile
+type ProfileRecord struct {
+	Profile    string
+	State      ProfileState
+	InstanceID string
+	SnapshotID string
+	Spec       map[string]string
+	Error      string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// RecordUpdate holds the fields a transition sets besides the state. Empty fields are kept.
+type RecordUpdate struct {
+	InstanceID string
+	SnapshotID string
+	Spec       map[string]string
+	Error      string
+}
+
+// ErrInvalidTransition is returned when a profile is not in a state the transition is allowed from
+type ErrInvalidTransition struct {
+	Profile string
+	From    ProfileState
+	To      ProfileState
+}
+
+func (e *ErrInvalidTransition) Error() string {
+	from := string(e.From)
+	if from == "" {
+		from = "unregistered"
+	}
+	return fmt.Sprintf("profile %s cannot move from %s to %s", e.Profile, from, e.To)
+}
+
+// Registry keeps the state of every profile in the lock table, so commands do not have to infer
+// it from instance tags and snapshots
+type Registry struct {
+	Client    *dynamodb.Client
+	TableName string
+}
+
+func NewRegistry(client *dynamodb.Client) *Registry {
+	return &Registry{
+		Client:    client,
+		TableName: TableName(),
+	}
+}
+
+func registryID(profile string) string {
+	return registryPrefix + profile
+}
+
+// Transition moves a profile to a new state with a conditional write, so it fails with an
+// *ErrInvalidTransition if another process moved the profile to a state the move is not allowed from.
+// Moving to archived or creating clears the instance ID and moving to any state but failed clears
+// the error, unless the update sets them.
+func (r *Registry) Transition(ctx context.Context, profile string, to ProfileState, update RecordUpdate) error {
+	from, ok := transitions[to]
+	if !ok {
+		return fmt.Errorf("unknown profile state %s", to)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	names := map[string]string{"#state": "State"}
+	values := map[string]types.AttributeValue{
+		":to":      &types.AttributeValueMemberS{Value: string(to)},
+		":now":     &types.AttributeValueMemberN{Value: now},
+		":profile": &types.AttributeValueMemberS{Value: profile},
+	}
+	set := []string{"#state = :to", "UpdatedAt = :now", "CreatedAt = if_not_exists(CreatedAt, :now)", "Profile = :profile"}
+	var remove []string
+
+	if update.InstanceID != "" {
+		set = append(set, "InstanceID = :instance")
+		values[":instance"] = &types.AttributeValueMemberS{Value: update.InstanceID}
+	} else if to == StateArchived || to == StateCreating {
+		remove = append(remove, "InstanceID")
+	}
+	if update.SnapshotID != "" {
+		set = append(set, "SnapshotID = :snapshot")
+		values[":snapshot"] = &types.AttributeValueMemberS{Value: update.SnapshotID}
+	}
+	if update.Spec != nil {
+		set = append(set, "Spec = :spec")
+		values[":spec"] = specAttr(update.Spec)
+	}
+	if update.Error != "" {
+		set = append(set, "LastError = :error")
+		values[":error"] = &types.AttributeValueMemberS{Value: update.Error}
+	} else if to != StateFailed {
+		remove = append(remove, "LastError")
+	}
+
+	var allowed []string
+	for i, state := range from {
+		if state == "" {
+			allowed = append(allowed, "attribute_not_exists(#state)")
+			continue
+		}
+		name := fmt.Sprintf(":from%d", i)
+		values[name] = &types.AttributeValueMemberS{Value: string(state)}
+		allowed = append(allowed, "#state = "+name)
+	}
+
+	expression := "SET " + strings.Join(set, ", ")
+	if len(remove) > 0 {
+		expression += " REMOVE " + strings.Join(remove, ", ")
+	}
+
+	_, err := r.Client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: registryID(profile)},
+		},
+		UpdateExpression:                    aws.String(expression),
+		ConditionExpression:                 aws.String(strings.Join(allowed, " OR ")),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	if err != nil {
+		var failed *types.ConditionalCheckFailedException
+		if errors.As(err, &failed) {
+			return &ErrInvalidTransition{
+				Profile: profile,
+				From:    ProfileState(stringAttr(failed.Item, "State")),
+				To:      to,
+			}
+		}
+		return fmt.Errorf("failed to move profile %s to %s: %w", profile, to, err)
+	}
+
+	return nil
+}
+
+// Put writes a record as is, without checking the current state. It is meant for repairs.
+func (r *Registry) Put(ctx context.Context, record ProfileRecord) error {
+	item := map[string]types.AttributeValue{
+		"LockID":    &types.AttributeValueMemberS{Value: registryID(record.Profile)},
+		"Profile":   &types.AttributeValueMemberS{Value: record.Profile},
+		"State":     &types.AttributeValueMemberS{Value: string(record.State)},
+		"CreatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(record.CreatedAt.Unix(), 10)},
+		"UpdatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(record.UpdatedAt.Unix(), 10)},
+	}
+	if record.InstanceID != "" {
+		item["InstanceID"] = &types.AttributeValueMemberS{Value: record.InstanceID}
+	}
+	if record.SnapshotID != "" {
+		item["SnapshotID"] = &types.AttributeValueMemberS{Value: record.SnapshotID}
+	}
+	if record.Spec != nil {
+		item["Spec"] = specAttr(record.Spec)
+	}
+	if record.Error != "" {
+		item["LastError"] = &types.AttributeValueMemberS{Value: record.Error}
+	}
+
+	_, err := r.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.TableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write registry record of profile %s: %w", record.Profile, err)
+	}
+
+	return nil
+}
+
+// Delete removes the record of a profile that no longer has an instance or snapshots
+func (r *Registry) Delete(ctx context.Context, profile string) error {
+	_, err := r.Client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: registryID(profile)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete registry record of profile %s: %w", profile, err)
+	}
+
+	return nil
+}
+
+// Get returns the record of a profile, or nil if the registry does not know it
+func (r *Registry) Get(ctx context.Context, profile string) (*ProfileRecord, error) {
+	output, err := r.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.TableName),
+		Key: map[string]types.AttributeValue{
+			"LockID": &types.AttributeValueMemberS{Value: registryID(profile)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry record of profile %s: %w", profile, err)
+	}
+
+	if output.Item == nil {
+		return nil, nil
+	}
+	record := recordFromItem(output.Item)
+	return &record, nil
+}
+
+// List returns the records of all profiles sorted by name
+func (r *Registry) List(ctx context.Context) ([]ProfileRecord, error) {
+	paginator := dynamodb.NewScanPaginator(r.Client, &dynamodb.ScanInput{
+		TableName:        aws.String(r.TableName),
+		FilterExpression: aws.String("begins_with(LockID, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: registryPrefix},
+		},
+	})
+
+	var records []ProfileRecord
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan profile registry: %w", err)
+		}
+		for _, item := range page.Items {
+			records = append(records, recordFromItem(item))
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Profile < records[j].Profile })
+	return records, nil
+}
+
+func recordFromItem(item map[string]types.AttributeValue) ProfileRecord {
+	record := ProfileRecord{
+		Profile:    stringAttr(item, "Profile"),
+		State:      ProfileState(stringAttr(item, "State")),
+		InstanceID: stringAttr(item, "InstanceID"),
+		SnapshotID: stringAttr(item, "SnapshotID"),
+		Error:      stringAttr(item, "LastError"),
+		CreatedAt:  time.Unix(numberAttr(item, "CreatedAt"), 0),
+		UpdatedAt:  time.Unix(numberAttr(item, "UpdatedAt"), 0),
+	}
+	if spec, ok := item["Spec"].(*types.AttributeValueMemberM); ok {
+		record.Spec = map[string]string{}
+		for key, value := range spec.Value {
+			if s, ok := value.(*types.AttributeValueMemberS); ok {
+				record.Spec[key] = s.Value
+			}
+		}
+	}
+	return record
+}
+
+func specAttr(spec map[string]string) types.AttributeValue {
+	values := make(map[string]types.AttributeValue, len(spec))
+	for key, value := range spec {
+		values[key] = &types.AttributeValueMemberS{Value: value}
+	}
+	return &types.AttributeValueMemberM{Value: values}
+}
@@ -0,0 +1,196 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/version"
+)
+
+const (
+	// ArchiveSourceCLI and ArchiveSourceAgent tell which side of Dumie created an archive
+	ArchiveSourceCLI   = "cli"
+	ArchiveSourceAgent = "agent"
+
+	// Tags recorded on every archive snapshot
+	ArchiveSourceTag  = "ArchiveSource"
+	ArchiveReasonTag  = "ArchiveReason"
+	InstanceTypeTag   = "InstanceType"
+	SourceAMITag      = "SourceAMI"
+	ParentSnapshotTag = "ParentSnapshot"
+	DumieVersionTag   = "DumieVersion"
+
+	// RestoredFromTag is set on instances restored from a snapshot and becomes the ParentSnapshot
+	// of their next archive
+	RestoredFromTag = "RestoredFrom"
+)
+
+// ArchiveOptions describes why and by whom a profile is archived
+type ArchiveOptions struct {
+	Profile string
+	// InstanceID is looked up by profile when empty
+	InstanceID string
+	Source     string
+	Reason     string
+	// Logger receives the warnings that do not fail the archive; nil discards them
+	Logger *log.Logger
+}
+
+// Archive snapshots the root volume of a profile's instance and returns the snapshot ID once it is
+// completed. It creates an AMI without rebooting, tags its root snapshot and deregisters the AMI.
+// The instance is left running; callers terminate it only after Archive succeeded.
+func Archive(ctx context.Context, client *ec2.Client, opts ArchiveOptions) (string, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	if opts.InstanceID == "" {
+		instanceID, err := SearchEC2Instance(client, opts.Profile)
+		if err != nil {
+			return "", err
+		}
+		if instanceID == nil {
+			return "", fmt.Errorf("no running instance found for profile %s", opts.Profile)
+		}
+		opts.InstanceID = *instanceID
+	}
+
+	output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{opts.InstanceID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe instance %s: %w", opts.InstanceID, err)
+	}
+	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+		return "", fmt.Errorf("instance %s not found", opts.InstanceID)
+	}
+	instance := output.Reservations[0].Instances[0]
+
+	imageOutput, err := client.CreateImage(ctx, &ec2.CreateImageInput{
+		InstanceId:          aws.String(opts.InstanceID),
+		Name:                aws.String(fmt.Sprintf("%s%s-%d", archiveImagePrefix, opts.InstanceID, time.Now().Unix())),
+		Description:         aws.String(fmt.Sprintf("Dumie archive of profile %s (%s)", opts.Profile, opts.Reason)),
+		NoReboot:            aws.Bool(true),
+		BlockDeviceMappings: excludeDataVolumes(instance),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeImage,
+				Tags: []types.Tag{
+					{Key: aws.String("Name"), Value: aws.String(opts.Profile)},
+					{Key: aws.String("ManagedBy"), Value: aws.String("Dumie")},
+				},
+			},
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags:         archiveTags(opts, instance),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create AMI from instance %s: %w", opts.InstanceID, err)
+	}
+	amiID := *imageOutput.ImageId
+
+	snapshotID, err := snapshotFromImage(ctx, client, amiID, opts.Profile)
+	if err != nil {
+		// Do not leave a half-created AMI behind; the instance is kept for a retry
+		if _, deregErr := client.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(amiID)}); deregErr != nil {
+			opts.Logger.Printf("failed to deregister AMI %s: %v", amiID, deregErr)
+		}
+		return "", err
+	}
+
+	// The snapshot is all we need to restore the profile. A leftover AMI does not put the
+	// archive at risk, so failing to deregister it is only a warning.
+	_, err = client.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(amiID)})
+	if err != nil {
+		opts.Logger.Printf("failed to deregister AMI %s: %v", amiID, err)
+	}
+
+	// Instances launched before encryption was turned on produce plain snapshots
+	if encryption := GetPolicy(instance.Tags).Encryption; encryption.Enabled() {
+		return encryptArchive(ctx, client, snapshotID, opts.Profile, encryption, opts.Logger)
+	}
+
+	return snapshotID, nil
+}
+
+// archiveTags are the tags every archive snapshot carries, whichever side created it
+func archiveTags(opts ArchiveOptions, instance types.Instance) []types.Tag {
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String(opts.Profile)},
+		{Key: aws.String("ManagedBy"), Value: aws.String("Dumie")},
+		{Key: aws.String("InstanceID"), Value: aws.String(opts.InstanceID)},
+		{Key: aws.String(ArchiveSourceTag), Value: aws.String(opts.Source)},
+		{Key: aws.String(ArchiveReasonTag), Value: aws.String(opts.Reason)},
+		{Key: aws.String(InstanceTypeTag), Value: aws.String(string(instance.InstanceType))},
+		{Key: aws.String(DumieVersionTag), Value: aws.String(version.Version)},
+	}
+	if instance.ImageId != nil {
+		tags = append(tags, types.Tag{Key: aws.String(SourceAMITag), Value: instance.ImageId})
+	}
+	for _, tag := range instance.Tags {
+		if tag.Key != nil && *tag.Key == RestoredFromTag && tag.Value != nil {
+			tags = append(tags, types.Tag{Key: aws.String(ParentSnapshotTag), Value: tag.Value})
+		}
+	}
+
+	// Carry the policy over so a restored instance keeps it
+	return append(tags, GetPolicy(instance.Tags).Tags()...)
+}
+
+// excludeDataVolumes leaves every volume but the root one out of the AMI of an archive. Only the
+// root snapshot is restored, so snapshots of the other volumes would be orphaned, and they would
+// carry the archive tags too.
+func excludeDataVolumes(instance types.Instance) []types.BlockDeviceMapping {
+	var mappings []types.BlockDeviceMapping
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.DeviceName == nil || aws.ToString(mapping.DeviceName) == aws.ToString(instance.RootDeviceName) {
+			continue
+		}
+		mappings = append(mappings, types.BlockDeviceMapping{
+			DeviceName: mapping.DeviceName,
+			NoDevice:   aws.String(""),
+		})
+	}
+	return mappings
+}
+
+// snapshotFromImage waits for an AMI and returns its root snapshot once that snapshot is completed
+func snapshotFromImage(ctx context.Context, client *ec2.Client, amiID, profile string) (string, error) {
+	waiter := ec2.NewImageAvailableWaiter(client)
+	err := waiter.Wait(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiID}}, imageAvailableTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed waiting for AMI %s to become available: %w", amiID, err)
+	}
+
+	images, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiID}})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe AMI %s: %w", amiID, err)
+	}
+
+	var snapshotID string
+	if len(images.Images) > 0 {
+		image := images.Images[0]
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil && aws.ToString(mapping.DeviceName) == aws.ToString(image.RootDeviceName) {
+				snapshotID = *mapping.Ebs.SnapshotId
+				break
+			}
+		}
+	}
+	if snapshotID == "" {
+		return "", fmt.Errorf("no snapshot found for AMI %s", amiID)
+	}
+
+	if err := WaitForArchiveSnapshot(ctx, client, snapshotID, profile); err != nil {
+		return "", err
+	}
+
+	return snapshotID, nil
+}
@@ -8,27 +8,12 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
-	"github.com/dumie-org/dumie-cli/internal/aws/ddb"
 )
 
-func RestoreOrCreateInstance(ctx context.Context, profile string, userDataPath *string, iamRoleARN *string, timeoutSeconds int) (string, error) {
-	lockClient, err := common.GetDynamoDBClient()
-	if err != nil {
-		return "", fmt.Errorf("failed to get DDB client: %w", err)
-	}
-	lock := ddb.NewDynamoDBLock(lockClient)
-	fmt.Println("Acquiring deployment lock for profile:", profile)
-	if err := lock.AcquireLock(ctx, profile); err != nil {
-		return "", fmt.Errorf("failed to acquire lock: %w", err)
-	}
-	defer func() {
-		fmt.Println("Releasing deployment lock for profile:", profile)
-		if err := lock.ReleaseLock(ctx, profile); err != nil {
-			fmt.Println("Failed to release lock:", err)
-		}
-	}()
-
-	client, err := common.GetEC2AWSClient()
+// RestoreOrCreateInstance starts the instance of a profile from its latest snapshot, or from
+// scratch if it has none. The caller must hold the profile lock, see ddb.ProfileLockID.
+func RestoreOrCreateInstance(ctx context.Context, profile string, userData *string, iamRoleARN *string, policy Policy) (string, error) {
+	client, err := common.GetEC2ClientForProfile(profile)
 	if err != nil {
 		return "", fmt.Errorf("failed to get EC2 client: %w", err)
 	}
@@ -42,7 +27,7 @@ func RestoreOrCreateInstance(ctx context.Context, profile string, userDataPath *
 	}
 
 	// Try restore from snapshot
-	instanceID, err := TryRestoreFromSnapshot(ctx, client, profile, iamRoleARN, timeoutSeconds)
+	instanceID, err := TryRestoreFromSnapshot(ctx, client, profile, iamRoleARN, policy)
 	if err != nil {
 		return "", err
 	}
@@ -52,18 +37,22 @@ func RestoreOrCreateInstance(ctx context.Context, profile string, userDataPath *
 	}
 
 	// Launch new instance
-	return launchNewInstance(ctx, client, profile, userDataPath, iamRoleARN, timeoutSeconds)
+	return launchNewInstance(ctx, client, profile, userData, iamRoleARN, policy)
 }
 
-func launchNewInstance(ctx context.Context, client *ec2.Client, profile string, userDataPath *string, iamRoleARN *string, timeoutSeconds int) (string, error) {
+func launchNewInstance(ctx context.Context, client *ec2.Client, profile string, userData *string, iamRoleARN *string, policy Policy) (string, error) {
 	fmt.Println("No snapshot found. Launching fresh instance.")
 
+	if policy.Encryption == "" {
+		policy.Encryption = DefaultEncryption()
+	}
+
 	amiID, err := GetLatestAmazonLinuxAMI(client)
 	if err != nil {
 		return "", fmt.Errorf("failed to get AMI: %w", err)
 	}
 
-	sgID, err := CreateOrGetSecurityGroup(client, "dumie-default-sg")
+	sgID, err := prepareProfileSecurityGroup(ctx, client, profile, policy.Ports)
 	if err != nil {
 		return "", fmt.Errorf("failed to get security group: %w", err)
 	}
@@ -73,16 +62,16 @@ func launchNewInstance(ctx context.Context, client *ec2.Client, profile string,
 		return "", fmt.Errorf("failed to get key pair: %w", err)
 	}
 
-	instanceIDPtr, err := LaunchEC2Instance(client, InstanceOptions{
-		Profile:        profile,
-		AMIID:          amiID,
-		InstanceType:   types.InstanceTypeT2Micro,
-		SecurityGroup:  sgID,
-		KeyName:        keyName,
-		UserDataPath:   userDataPath,
-		IAMRoleARN:     iamRoleARN,
-		Restored:       false,
-		TimeoutSeconds: timeoutSeconds,
+	instanceIDPtr, err := LaunchEC2Instance(ctx, client, InstanceOptions{
+		Profile:       profile,
+		AMIID:         amiID,
+		InstanceType:  types.InstanceTypeT2Micro,
+		SecurityGroup: sgID,
+		KeyName:       keyName,
+		UserData:      userData,
+		IAMRoleARN:    iamRoleARN,
+		Restored:      false,
+		Policy:        policy,
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to launch instance: %w", err)
@@ -7,10 +7,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"os"
-	"os/exec"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -21,15 +18,16 @@ import (
 
 // InstanceOptions contains all options for creating an EC2 instance
 type InstanceOptions struct {
-	Profile        string
-	AMIID          string
-	InstanceType   types.InstanceType
-	SecurityGroup  *string
-	KeyName        string
-	UserDataPath   *string
-	IAMRoleARN     *string
-	Restored       bool
-	TimeoutSeconds int
+	Profile       string
+	AMIID         string
+	InstanceType  types.InstanceType
+	SecurityGroup *string
+	KeyName       string
+	UserData      *string
+	IAMRoleARN    *string
+	Restored      bool
+	RestoredFrom  string
+	Policy        Policy
 }
 
 func GetDefaultVPCID(client *ec2.Client) (*string, error) {
@@ -52,54 +50,6 @@ func GetDefaultVPCID(client *ec2.Client) (*string, error) {
 	return describeVPCsOutput.Vpcs[0].VpcId, nil
 }
 
-func CreateOrGetSecurityGroup(client *ec2.Client, groupName string) (*string, error) {
-	describeSGInput := &ec2.DescribeSecurityGroupsInput{
-		GroupNames: []string{groupName},
-	}
-	describeSGOutput, err := client.DescribeSecurityGroups(context.TODO(), describeSGInput)
-	if err == nil && len(describeSGOutput.SecurityGroups) > 0 {
-		return describeSGOutput.SecurityGroups[0].GroupId, nil
-	}
-
-	vpcID, err := GetDefaultVPCID(client)
-	if err != nil {
-		return nil, fmt.Errorf("error getting default VPC ID: %w", err)
-	}
-
-	createSGInput := &ec2.CreateSecurityGroupInput{
-		GroupName:   &groupName,
-		Description: aws.String("Security Group managed by Dumie"),
-		VpcId:       vpcID,
-	}
-	createSGOutput, err := client.CreateSecurityGroup(context.TODO(), createSGInput)
-	if err != nil {
-		return nil, fmt.Errorf("error creating Security Group: %w", err)
-	}
-
-	authorizeSGInput := &ec2.AuthorizeSecurityGroupIngressInput{
-		GroupId: createSGOutput.GroupId,
-		IpPermissions: []types.IpPermission{
-			{
-				IpProtocol: aws.String("tcp"),
-				FromPort:   aws.Int32(22),
-				ToPort:     aws.Int32(22),
-				IpRanges: []types.IpRange{
-					{
-						// TODO: This should be restricted to the user's IP address only *IMPORTANT
-						CidrIp: aws.String("0.0.0.0/0"),
-					},
-				},
-			},
-		},
-	}
-	_, err = client.AuthorizeSecurityGroupIngress(context.TODO(), authorizeSGInput)
-	if err != nil {
-		return nil, fmt.Errorf("error authorizing Security Group ingress: %w", err)
-	}
-
-	return createSGOutput.GroupId, nil
-}
-
 func SearchEC2Instance(client *ec2.Client, profile string) (*string, error) {
 	describeInstancesInput := &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
@@ -125,27 +75,17 @@ func SearchEC2Instance(client *ec2.Client, profile string) (*string, error) {
 	return describeInstancesOutput.Reservations[0].Instances[0].InstanceId, nil
 }
 
-func LaunchEC2Instance(client *ec2.Client, opts InstanceOptions) (*string, error) {
+func LaunchEC2Instance(ctx context.Context, client *ec2.Client, opts InstanceOptions) (*string, error) {
 	var userData *string
-	if opts.UserDataPath != nil {
-		// Load and encode user_data script
-		userDataBytes, err := os.ReadFile(*opts.UserDataPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read user_data script: %w", err)
-		}
-		
-		// Replace the TIMEOUT_SECONDS placeholder in the script
-		scriptContent := string(userDataBytes)
-		scriptContent = strings.ReplaceAll(scriptContent, "TIMEOUT_SECONDS=${TIMEOUT_SECONDS:-60}", fmt.Sprintf("TIMEOUT_SECONDS=%d", opts.TimeoutSeconds))
-		
-		encodedData := base64.StdEncoding.EncodeToString([]byte(scriptContent))
+	if opts.UserData != nil {
+		encodedData := base64.StdEncoding.EncodeToString([]byte(*opts.UserData))
 		userData = &encodedData
 	}
 
 	tags := []types.TagSpecification{
 		{
 			ResourceType: types.ResourceTypeInstance,
-			Tags: []types.Tag{
+			Tags: append([]types.Tag{
 				{
 					Key:   aws.String("Name"),
 					Value: aws.String(opts.Profile),
@@ -158,13 +98,15 @@ func LaunchEC2Instance(client *ec2.Client, opts InstanceOptions) (*string, error
 					Key:   aws.String("Restored"),
 					Value: aws.String(strconv.FormatBool(opts.Restored)),
 				},
-				{
-					Key:   aws.String("TimeoutSeconds"),
-					Value: aws.String(strconv.Itoa(opts.TimeoutSeconds)),
-				},
-			},
+			}, opts.Policy.Tags()...),
 		},
 	}
+	if opts.RestoredFrom != "" {
+		tags[0].Tags = append(tags[0].Tags, types.Tag{
+			Key:   aws.String(RestoredFromTag),
+			Value: aws.String(opts.RestoredFrom),
+		})
+	}
 
 	runInstancesInput := &ec2.RunInstancesInput{
 		TagSpecifications: tags,
@@ -176,28 +118,43 @@ func LaunchEC2Instance(client *ec2.Client, opts InstanceOptions) (*string, error
 			*opts.SecurityGroup,
 		},
 		KeyName: aws.String(opts.KeyName),
+		// The monitor reads its policy from instance tags through IMDSv2
+		MetadataOptions: &types.InstanceMetadataOptionsRequest{
+			HttpEndpoint:         types.InstanceMetadataEndpointStateEnabled,
+			HttpTokens:           types.HttpTokensStateRequired,
+			InstanceMetadataTags: types.InstanceMetadataTagsStateEnabled,
+		},
 	}
 
 	if userData != nil {
 		runInstancesInput.UserData = userData
 	}
 
+	if opts.Policy.Encryption.Enabled() {
+		mappings, err := encryptedBlockDevices(ctx, client, opts.AMIID, opts.Policy.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		runInstancesInput.BlockDeviceMappings = mappings
+	}
+
 	if opts.IAMRoleARN != nil {
 		runInstancesInput.IamInstanceProfile = &types.IamInstanceProfileSpecification{
 			Name: aws.String("DumieInstanceManagerProfile"),
 		}
 	}
 
-	runInstancesOutput, err := client.RunInstances(context.TODO(), runInstancesInput)
+	runInstancesOutput, err := client.RunInstances(ctx, runInstancesInput)
 	if err != nil {
 		return nil, fmt.Errorf("error running instances: %w", err)
 	}
 
 	instanceID := runInstancesOutput.Instances[0].InstanceId
 
-	err = waitForInstanceRunning(context.TODO(), client, *instanceID)
+	err = waitForInstanceRunning(ctx, client, *instanceID)
 	if err != nil {
-		return nil, fmt.Errorf("error waiting for instance: %w", err)
+		// The instance exists and carries the profile tags, so the next dumie use finds it
+		return nil, fmt.Errorf("error waiting for instance %s: %w", *instanceID, err)
 	}
 
 	return instanceID, nil
@@ -210,7 +167,11 @@ func waitForInstanceRunning(ctx context.Context, client *ec2.Client, instanceID
 	}
 
 	// Add a delay to allow user data script to complete
-	time.Sleep(30 * time.Second)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(30 * time.Second):
+	}
 	return nil
 }
 
@@ -278,7 +239,7 @@ func TerminateInstance(ctx context.Context, client *ec2.Client, instanceID strin
 }
 
 func RegisterAMIFromSnapshot(ctx context.Context, client *ec2.Client, snapshotID string) (string, error) {
-	name := fmt.Sprintf("dumie-ami-from-%s", snapshotID)
+	name := archiveImagePrefix + snapshotID
 
 	// check existing ami
 	describeInput := &ec2.DescribeImagesInput{
@@ -296,7 +257,7 @@ func RegisterAMIFromSnapshot(ctx context.Context, client *ec2.Client, snapshotID
 	}
 
 	input := &ec2.RegisterImageInput{
-		Name: aws.String(fmt.Sprintf("dumie-ami-from-%s", snapshotID)),
+		Name: aws.String(archiveImagePrefix + snapshotID),
 		BlockDeviceMappings: []types.BlockDeviceMapping{
 			{
 				DeviceName: aws.String("/dev/xvda"),
@@ -339,40 +300,55 @@ func GetInstancePublicDNS(client *ec2.Client, instanceID string) (string, error)
 	return *instance.PublicDnsName, nil
 }
 
-// UpdateInstanceTimeout updates the timeout value in the SSH monitoring script on a running instance
-func UpdateInstanceTimeout(ctx context.Context, client *ec2.Client, instanceID string, timeoutSeconds int) error {
-	// Get instance public DNS
-	publicDNS, err := GetInstancePublicDNS(client, instanceID)
+// FindLatestInstance returns the most recently launched Dumie instance of a profile in any state,
+// including recently terminated ones, or nil if there is none
+func FindLatestInstance(ctx context.Context, client *ec2.Client, profile string) (*types.Instance, error) {
+	output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:Name"),
+				Values: []string{profile},
+			},
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"Dumie"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing instances: %w", err)
+	}
+
+	var latest *types.Instance
+	for _, r := range output.Reservations {
+		for i := range r.Instances {
+			inst := &r.Instances[i]
+			if latest == nil || (inst.LaunchTime != nil && latest.LaunchTime != nil && inst.LaunchTime.After(*latest.LaunchTime)) {
+				latest = inst
+			}
+		}
+	}
+
+	return latest, nil
+}
+
+// GetConsoleOutput returns the decoded serial console output of an instance
+func GetConsoleOutput(ctx context.Context, client *ec2.Client, instanceID string) (string, error) {
+	output, err := client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instanceID),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get public DNS: %w", err)
+		return "", fmt.Errorf("failed to get console output of instance %s: %w", instanceID, err)
 	}
 
-	// Create a temporary script to update the timeout
-	updateScript := fmt.Sprintf(`#!/bin/bash
-# Update timeout in SSH monitoring script
-sudo sed -i 's/TIMEOUT_SECONDS=[0-9]*/TIMEOUT_SECONDS=%d/' /usr/local/bin/ssh_monitor.sh
-# Restart the SSH monitoring service
-sudo systemctl restart ssh-monitor.service
-echo "Timeout updated to %d seconds"`, timeoutSeconds, timeoutSeconds)
+	if output.Output == nil {
+		return "", nil
+	}
 
-	// Execute the script on the instance
-	keyPairName, err := common.GetKeyPairName()
+	decoded, err := base64.StdEncoding.DecodeString(*output.Output)
 	if err != nil {
-		return fmt.Errorf("failed to get key pair name: %w", err)
-	}
-
-	keyFilePath := fmt.Sprintf("%s.pem", keyPairName)
-	
-	// Use SSH to execute the update script
-	sshCmd := exec.Command("ssh", 
-		"-i", keyFilePath,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		fmt.Sprintf("ec2-user@%s", publicDNS),
-		updateScript)
-	
-	sshCmd.Stdout = os.Stdout
-	sshCmd.Stderr = os.Stderr
-	
-	return sshCmd.Run()
+		return "", fmt.Errorf("failed to decode console output of instance %s: %w", instanceID, err)
+	}
+
+	return string(decoded), nil
 }
@@ -0,0 +1,189 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/dumie-org/dumie-cli/internal/aws/common"
+)
+
+const (
+	// EncryptionTag holds the volume encryption of a profile on its instance and snapshots
+	EncryptionTag = "Encryption"
+
+	// EncryptionNone keeps the account defaults and leaves archives as they are
+	EncryptionNone Encryption = "none"
+
+	// EncryptionDefault encrypts with the account's default EBS KMS key
+	EncryptionDefault Encryption = "default"
+)
+
+// kmsKeyIDPattern matches a bare KMS key ID, which is a UUID
+var kmsKeyIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Encryption is the volume encryption of a profile: EncryptionNone, EncryptionDefault or a KMS
+// key ID, alias or ARN. The empty value means not set, so the configured default applies.
+type Encryption string
+
+// ParseEncryption validates an encryption setting
+func ParseEncryption(value string) (Encryption, error) {
+	switch {
+	case value == "", value == string(EncryptionNone), value == string(EncryptionDefault):
+		return Encryption(value), nil
+	case strings.HasPrefix(value, "arn:aws:kms:"), strings.HasPrefix(value, "alias/"), kmsKeyIDPattern.MatchString(value):
+		return Encryption(value), nil
+	}
+	return "", fmt.Errorf("invalid encryption %q (expected none, default or a KMS key ID, alias or ARN)", value)
+}
+
+// Enabled reports whether volumes and archives must be encrypted
+func (e Encryption) Enabled() bool {
+	return e != "" && e != EncryptionNone
+}
+
+// KMSKeyID returns the KMS key to encrypt with, or "" for the account default key
+func (e Encryption) KMSKeyID() string {
+	if !e.Enabled() || e == EncryptionDefault {
+		return ""
+	}
+	return string(e)
+}
+
+// DefaultEncryption returns the encryption configured for profiles without their own setting
+func DefaultEncryption() Encryption {
+	cfg, err := common.LoadAWSConfig()
+	if err != nil {
+		return ""
+	}
+	encryption, err := ParseEncryption(cfg.Encryption)
+	if err != nil {
+		fmt.Printf("Warning: ignoring configured encryption: %v\n", err)
+		return ""
+	}
+	return encryption
+}
+
+// encryptedBlockDevices returns block device mappings that encrypt every EBS volume of an AMI
+func encryptedBlockDevices(ctx context.Context, client *ec2.Client, amiID string, encryption Encryption) ([]types.BlockDeviceMapping, error) {
+	output, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: []string{amiID}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe AMI %s: %w", amiID, err)
+	}
+	if len(output.Images) == 0 {
+		return nil, fmt.Errorf("AMI %s not found", amiID)
+	}
+
+	var mappings []types.BlockDeviceMapping
+	for _, mapping := range output.Images[0].BlockDeviceMappings {
+		if mapping.Ebs == nil {
+			continue
+		}
+		ebs := &types.EbsBlockDevice{
+			Encrypted:           aws.Bool(true),
+			DeleteOnTermination: mapping.Ebs.DeleteOnTermination,
+			VolumeSize:          mapping.Ebs.VolumeSize,
+			VolumeType:          mapping.Ebs.VolumeType,
+		}
+		if keyID := encryption.KMSKeyID(); keyID != "" {
+			ebs.KmsKeyId = aws.String(keyID)
+		}
+		mappings = append(mappings, types.BlockDeviceMapping{
+			DeviceName: mapping.DeviceName,
+			Ebs:        ebs,
+		})
+	}
+	return mappings, nil
+}
+
+// encryptArchive replaces an unencrypted archive snapshot by an encrypted copy with the same tags
+func encryptArchive(ctx context.Context, client *ec2.Client, snapshotID, profile string, encryption Encryption, logger *log.Logger) (string, error) {
+	output, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{SnapshotIds: []string{snapshotID}})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe snapshot %s: %w", snapshotID, err)
+	}
+	if len(output.Snapshots) == 0 {
+		return "", fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+	snapshot := output.Snapshots[0]
+	if aws.ToBool(snapshot.Encrypted) {
+		return snapshotID, nil
+	}
+
+	region := client.Options().Region
+	description := fmt.Sprintf("Dumie archive of profile %s (encrypted)", profile)
+	input := &ec2.CopySnapshotInput{
+		SourceRegion:     aws.String(region),
+		SourceSnapshotId: aws.String(snapshotID),
+		Description:      aws.String(description),
+		Encrypted:        aws.Bool(true),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags:         copyableTags(snapshot),
+			},
+		},
+	}
+	if keyID := encryption.KMSKeyID(); keyID != "" {
+		input.KmsKeyId = aws.String(keyID)
+	}
+
+	copyOutput, err := client.CopySnapshot(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy snapshot %s encrypted: %w", snapshotID, err)
+	}
+	encryptedID := aws.ToString(copyOutput.SnapshotId)
+
+	if err := WaitForArchiveSnapshot(ctx, client, encryptedID, profile); err != nil {
+		return "", err
+	}
+
+	// The encrypted copy is complete, so the plain snapshot can go
+	_, err = client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotID)})
+	if err != nil {
+		logger.Printf("failed to delete unencrypted snapshot %s: %v", snapshotID, err)
+	}
+
+	return encryptedID, nil
+}
+
+// VolumeEncryption describes the encryption of an instance's EBS volumes for display
+func VolumeEncryption(ctx context.Context, client *ec2.Client, instance types.Instance) (string, error) {
+	var volumeIDs []string
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+			volumeIDs = append(volumeIDs, *mapping.Ebs.VolumeId)
+		}
+	}
+	if len(volumeIDs) == 0 {
+		return "-", nil
+	}
+
+	output, err := client.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{VolumeIds: volumeIDs})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe volumes: %w", err)
+	}
+
+	encrypted := 0
+	keyID := ""
+	for _, volume := range output.Volumes {
+		if aws.ToBool(volume.Encrypted) {
+			encrypted++
+			keyID = aws.ToString(volume.KmsKeyId)
+		}
+	}
+
+	switch {
+	case encrypted == 0:
+		return "not encrypted", nil
+	case encrypted < len(output.Volumes):
+		return fmt.Sprintf("%d of %d volumes encrypted", encrypted, len(output.Volumes)), nil
+	default:
+		return fmt.Sprintf("encrypted (%s)", keyID), nil
+	}
+}
@@ -0,0 +1,303 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// OrphanAMI, OrphanSnapshot and OrphanSecurityGroup are the kinds of EC2 resources gc removes
+	OrphanAMI           = "ami"
+	OrphanSnapshot      = "snapshot"
+	OrphanSecurityGroup = "security-group"
+
+	// SnapshotCostPerGiBMonth is the list price of EBS snapshot storage in USD. Snapshots are
+	// incremental, so size times this price is an upper bound.
+	SnapshotCostPerGiBMonth = 0.05
+
+	// archiveImagePrefix starts the name of every AMI Dumie creates
+	archiveImagePrefix = "dumie-ami-from-"
+
+	// gcMinAge keeps gc away from resources an archive in progress may still be working on
+	gcMinAge = 3 * time.Hour
+)
+
+// createImageDescription matches the description EC2 gives to the snapshots of CreateImage
+var createImageDescription = regexp.MustCompile(`^Created by CreateImage\((i-[0-9a-f]+)\) for (ami-[0-9a-f]+)`)
+
+// Orphan is a Dumie resource that no profile uses anymore
+type Orphan struct {
+	Kind        string
+	ID          string
+	Detail      string
+	MonthlyCost float64
+	// Snapshots are the untagged snapshots of an AMI, deleted together with it
+	Snapshots []string
+}
+
+// FindOrphans returns the AMIs, snapshots and security groups Dumie left behind
+func FindOrphans(ctx context.Context, client *ec2.Client) ([]Orphan, error) {
+	now := time.Now()
+
+	inUse, err := imagesInUse(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ownImages(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := ownSnapshots(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]types.Snapshot{}
+	for _, snap := range snapshots {
+		byID[aws.ToString(snap.SnapshotId)] = snap
+	}
+
+	var orphans []Orphan
+	freed := map[string]bool{}
+	for _, image := range images {
+		imageID := aws.ToString(image.ImageId)
+		if !strings.HasPrefix(aws.ToString(image.Name), archiveImagePrefix) {
+			continue
+		}
+		if inUse[imageID] || image.State == types.ImageStatePending || !oldEnough(aws.ToString(image.CreationDate), now) {
+			continue
+		}
+
+		// The snapshots of an archive stay with their profile; the others go with the AMI
+		orphan := Orphan{Kind: OrphanAMI, ID: imageID}
+		var size int32
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.Ebs == nil {
+				continue
+			}
+			snap, ok := byID[aws.ToString(mapping.Ebs.SnapshotId)]
+			if !ok || tagValue(snap.Tags, "Name") != "" {
+				continue
+			}
+			orphan.Snapshots = append(orphan.Snapshots, aws.ToString(snap.SnapshotId))
+			freed[aws.ToString(snap.SnapshotId)] = true
+			size += aws.ToInt32(snap.VolumeSize)
+		}
+		orphan.Detail = fmt.Sprintf("%s, %d snapshot(s), %d GiB", aws.ToString(image.Name), len(orphan.Snapshots), size)
+		orphan.MonthlyCost = float64(size) * SnapshotCostPerGiBMonth
+		orphans = append(orphans, orphan)
+	}
+
+	orphans = append(orphans, orphanSnapshots(snapshots, images, freed, now)...)
+
+	groups, err := orphanSecurityGroups(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return append(orphans, groups...), nil
+}
+
+// DeleteOrphan removes one resource found by FindOrphans
+func DeleteOrphan(ctx context.Context, client *ec2.Client, orphan Orphan) error {
+	var err error
+	switch orphan.Kind {
+	case OrphanAMI:
+		_, err = client.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(orphan.ID)})
+		for _, snapshotID := range orphan.Snapshots {
+			if err != nil {
+				break
+			}
+			if _, snapErr := client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotID)}); snapErr != nil {
+				err = fmt.Errorf("AMI deregistered, but snapshot %s was not deleted: %w", snapshotID, snapErr)
+			}
+		}
+	case OrphanSnapshot:
+		_, err = client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(orphan.ID)})
+	case OrphanSecurityGroup:
+		_, err = client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(orphan.ID)})
+	default:
+		err = fmt.Errorf("unknown resource kind %s", orphan.Kind)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s %s: %w", orphan.Kind, orphan.ID, err)
+	}
+	return nil
+}
+
+// imagesInUse returns the AMIs that instances which are not terminated were launched from
+func imagesInUse(ctx context.Context, client *ec2.Client) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	paginator := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"pending", "running", "stopping", "stopped"},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			for _, inst := range r.Instances {
+				inUse[aws.ToString(inst.ImageId)] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// ownImages returns every AMI of this account
+func ownImages(ctx context.Context, client *ec2.Client) ([]types.Image, error) {
+	var images []types.Image
+	paginator := ec2.NewDescribeImagesPaginator(client, &ec2.DescribeImagesInput{
+		Owners: []string{"self"},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe AMIs: %w", err)
+		}
+		images = append(images, page.Images...)
+	}
+	return images, nil
+}
+
+// ownSnapshots returns every snapshot of this account
+func ownSnapshots(ctx context.Context, client *ec2.Client) ([]types.Snapshot, error) {
+	var snapshots []types.Snapshot
+	paginator := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe snapshots: %w", err)
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+	}
+	return snapshots, nil
+}
+
+// orphanSnapshots returns snapshots that belong to no profile and are not freed with an AMI:
+// Dumie snapshots without a Name tag, and untagged CreateImage snapshots of Dumie AMIs left behind
+// by failed archives. Snapshots of AMIs that are gone are kept, as nothing tells whether Dumie made them.
+func orphanSnapshots(snapshots []types.Snapshot, images []types.Image, freed map[string]bool, now time.Time) []Orphan {
+	dumieImages := map[string]bool{}
+	for _, image := range images {
+		if strings.HasPrefix(aws.ToString(image.Name), archiveImagePrefix) {
+			dumieImages[aws.ToString(image.ImageId)] = true
+		}
+	}
+
+	var orphans []Orphan
+	for _, snap := range snapshots {
+		if freed[aws.ToString(snap.SnapshotId)] {
+			continue
+		}
+		if snap.State == types.SnapshotStatePending || now.Sub(aws.ToTime(snap.StartTime)) < gcMinAge {
+			continue
+		}
+		if tagValue(snap.Tags, "Name") != "" {
+			continue
+		}
+
+		detail := ""
+		m := createImageDescription.FindStringSubmatch(aws.ToString(snap.Description))
+		switch {
+		case tagValue(snap.Tags, "ManagedBy") == "Dumie":
+			detail = "Dumie snapshot without a profile"
+		case m != nil && dumieImages[m[2]]:
+			detail = fmt.Sprintf("untagged snapshot of %s from %s", m[2], m[1])
+		default:
+			continue
+		}
+
+		size := aws.ToInt32(snap.VolumeSize)
+		orphans = append(orphans, Orphan{
+			Kind:        OrphanSnapshot,
+			ID:          aws.ToString(snap.SnapshotId),
+			Detail:      fmt.Sprintf("%s, %d GiB", detail, size),
+			MonthlyCost: float64(size) * SnapshotCostPerGiBMonth,
+		})
+	}
+	return orphans
+}
+
+// orphanSecurityGroups returns Dumie-managed security groups that no network interface uses and whose
+// profile, if any, has no archive left
+func orphanSecurityGroups(ctx context.Context, client *ec2.Client) ([]Orphan, error) {
+	var groups []types.SecurityGroup
+	paginator := ec2.NewDescribeSecurityGroupsPaginator(client, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []string{"dumie-*"},
+			},
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"Dumie"},
+			},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe security groups: %w", err)
+		}
+		groups = append(groups, page.SecurityGroups...)
+	}
+
+	var orphans []Orphan
+	for _, group := range groups {
+		enis, err := client.DescribeNetworkInterfaces(ctx, &ec2.DescribeNetworkInterfacesInput{
+			Filters: []types.Filter{
+				{
+					Name:   aws.String("group-id"),
+					Values: []string{aws.ToString(group.GroupId)},
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe network interfaces: %w", err)
+		}
+		if len(enis.NetworkInterfaces) > 0 {
+			continue
+		}
+
+		// The group of an archived profile is kept for its next restore
+		if profile := tagValue(group.Tags, ProfileTag); profile != "" {
+			snapshot, err := LatestSnapshot(ctx, client, profile)
+			if err != nil {
+				return nil, err
+			}
+			if snapshot != nil {
+				continue
+			}
+		}
+		orphans = append(orphans, Orphan{
+			Kind:   OrphanSecurityGroup,
+			ID:     aws.ToString(group.GroupId),
+			Detail: aws.ToString(group.GroupName),
+		})
+	}
+	return orphans, nil
+}
+
+// oldEnough reports whether an EC2 creation date is at least gcMinAge ago
+func oldEnough(creationDate string, now time.Time) bool {
+	created, err := time.Parse(time.RFC3339, creationDate)
+	if err != nil {
+		return false
+	}
+	return now.Sub(created) >= gcMinAge
+}
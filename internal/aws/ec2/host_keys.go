@@ -0,0 +1,71 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+const (
+	// hostKeysBegin and hostKeysEnd enclose the public host keys cloud-init prints to the console
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+
+	// hostKeysPollInterval is how often the console output is read while waiting for the host keys
+	hostKeysPollInterval = 15 * time.Second
+)
+
+// ParseHostKeys returns the host keys of the last boot in a console output as "type base64" pairs
+func ParseHostKeys(console string) []string {
+	start := strings.LastIndex(console, hostKeysBegin)
+	if start < 0 {
+		return nil
+	}
+	block, _, ok := strings.Cut(console[start+len(hostKeysBegin):], hostKeysEnd)
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	for _, line := range strings.Split(block, "\n") {
+		fields := strings.Fields(line)
+		// Console lines may carry a cloud-init prefix, so look for the key type
+		for i := 0; i+1 < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "ssh-") || strings.HasPrefix(fields[i], "ecdsa-") {
+				keys = append(keys, fields[i]+" "+fields[i+1])
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// WaitForHostKeys waits until an instance has printed its host keys to the console. EC2 only
+// publishes console output a few minutes after boot.
+func WaitForHostKeys(ctx context.Context, client *ec2.Client, instanceID string, timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(hostKeysPollInterval)
+	defer ticker.Stop()
+
+	fmt.Printf("Waiting for instance [%s] to print its SSH host keys...\n", instanceID)
+	for {
+		console, err := GetConsoleOutput(ctx, client, instanceID)
+		if err != nil {
+			return nil, err
+		}
+		if keys := ParseHostKeys(console); len(keys) > 0 {
+			return keys, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no SSH host keys in the console output of instance %s after %s: %w", instanceID, timeout, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
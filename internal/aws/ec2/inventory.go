@@ -0,0 +1,120 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Inventory is what EC2 holds for each profile in one region
+type Inventory struct {
+	// Instances holds the instance of each profile that is not terminated, preferring running ones
+	Instances map[string]types.Instance
+
+	// Snapshots holds the newest completed snapshot of each profile
+	Snapshots map[string]types.Snapshot
+}
+
+// Profiles returns every profile that has an instance or a snapshot
+func (inv *Inventory) Profiles() []string {
+	seen := map[string]bool{}
+	var profiles []string
+	for profile := range inv.Instances {
+		seen[profile] = true
+		profiles = append(profiles, profile)
+	}
+	for profile := range inv.Snapshots {
+		if !seen[profile] {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles
+}
+
+// TakeInventory collects the Dumie instances and snapshots of a region by profile
+func TakeInventory(ctx context.Context, client *ec2.Client) (*Inventory, error) {
+	inv := &Inventory{
+		Instances: map[string]types.Instance{},
+		Snapshots: map[string]types.Snapshot{},
+	}
+
+	instances := ec2.NewDescribeInstancesPaginator(client, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"Dumie"},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"pending", "running", "stopping", "stopped"},
+			},
+		},
+	})
+	for instances.HasMorePages() {
+		page, err := instances.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instances: %w", err)
+		}
+		for _, r := range page.Reservations {
+			for _, inst := range r.Instances {
+				profile := nameTag(inst.Tags)
+				if profile == "" {
+					continue
+				}
+				if current, ok := inv.Instances[profile]; ok && current.State.Name == types.InstanceStateNameRunning {
+					continue
+				}
+				inv.Instances[profile] = inst
+			}
+		}
+	}
+
+	snapshots := ec2.NewDescribeSnapshotsPaginator(client, &ec2.DescribeSnapshotsInput{
+		OwnerIds: []string{"self"},
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"Dumie"},
+			},
+			{
+				Name:   aws.String("status"),
+				Values: []string{string(types.SnapshotStateCompleted)},
+			},
+		},
+	})
+	for snapshots.HasMorePages() {
+		page, err := snapshots.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe snapshots: %w", err)
+		}
+		for _, snap := range page.Snapshots {
+			profile := nameTag(snap.Tags)
+			if profile == "" {
+				continue
+			}
+			if current, ok := inv.Snapshots[profile]; ok && !aws.ToTime(snap.StartTime).After(aws.ToTime(current.StartTime)) {
+				continue
+			}
+			inv.Snapshots[profile] = snap
+		}
+	}
+
+	return inv, nil
+}
+
+func nameTag(tags []types.Tag) string {
+	return tagValue(tags, "Name")
+}
+
+// tagValue returns the value of a tag, or "" if it is not set
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
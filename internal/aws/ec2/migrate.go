@@ -0,0 +1,48 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// MigratedFromTag records the region and snapshot a migrated snapshot was copied from
+const MigratedFromTag = "MigratedFrom"
+
+// CopySnapshotToRegion copies an archive snapshot into the region of the target client, carries its
+// tags over and waits until the copy is completed. A non-empty kmsKeyID encrypts the copy with that
+// key of the target region, otherwise an encrypted snapshot is copied with the target's default key.
+func CopySnapshotToRegion(ctx context.Context, target *ec2.Client, sourceRegion, profile string, snapshot types.Snapshot, kmsKeyID string) (string, error) {
+	sourceID := aws.ToString(snapshot.SnapshotId)
+
+	// A KMS key of the source region cannot be used in the target region
+	var tags []types.Tag
+	encryption := Encryption("")
+	for _, tag := range copyableTags(snapshot) {
+		if aws.ToString(tag.Key) == EncryptionTag {
+			encryption = Encryption(aws.ToString(tag.Value))
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	switch {
+	case kmsKeyID != "":
+		encryption = Encryption(kmsKeyID)
+	case encryption.KMSKeyID() != "":
+		encryption = EncryptionDefault
+	}
+	if encryption != "" {
+		tags = append(tags, types.Tag{Key: aws.String(EncryptionTag), Value: aws.String(string(encryption))})
+	}
+
+	tags = append(tags, types.Tag{
+		Key:   aws.String(MigratedFromTag),
+		Value: aws.String(fmt.Sprintf("%s/%s", sourceRegion, sourceID)),
+	})
+
+	description := fmt.Sprintf("Dumie archive of profile %s migrated from %s", profile, sourceRegion)
+	return copySnapshot(ctx, target, sourceRegion, sourceID, profile, description, tags, kmsKeyID)
+}
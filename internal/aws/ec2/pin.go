@@ -0,0 +1,116 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// PinnedTag marks an instance that must not be archived by the on-instance monitor
+	PinnedTag = "Pinned"
+
+	// PinnedUntilTag holds the optional RFC 3339 expiry of a pin
+	PinnedUntilTag = "PinnedUntil"
+)
+
+// PinInfo describes the pin state of an instance as recorded in its tags
+type PinInfo struct {
+	Pinned bool
+	Until  *time.Time
+}
+
+// Active reports whether the pin still protects the instance at the given time
+func (p PinInfo) Active(now time.Time) bool {
+	if !p.Pinned {
+		return false
+	}
+	return p.Until == nil || now.Before(*p.Until)
+}
+
+// String renders the pin state for list and status output
+func (p PinInfo) String() string {
+	if !p.Active(time.Now()) {
+		return "no"
+	}
+	if p.Until == nil {
+		return "yes"
+	}
+	return fmt.Sprintf("until %s", p.Until.Local().Format("2006-01-02 15:04:05"))
+}
+
+// GetPinInfo extracts the pin state from a set of instance tags
+func GetPinInfo(tags []types.Tag) PinInfo {
+	var info PinInfo
+	for _, tag := range tags {
+		if tag.Key == nil || tag.Value == nil {
+			continue
+		}
+		switch *tag.Key {
+		case PinnedTag:
+			info.Pinned = *tag.Value == "true"
+		case PinnedUntilTag:
+			until, err := time.Parse(time.RFC3339, *tag.Value)
+			if err == nil {
+				info.Until = &until
+			}
+		}
+	}
+	return info
+}
+
+// PinInstance tags an instance so that it is never auto-archived, optionally until the given time
+func PinInstance(ctx context.Context, client *ec2.Client, instanceID string, until *time.Time) error {
+	tags := []types.Tag{
+		{
+			Key:   aws.String(PinnedTag),
+			Value: aws.String("true"),
+		},
+	}
+
+	if until != nil {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(PinnedUntilTag),
+			Value: aws.String(until.UTC().Format(time.RFC3339)),
+		})
+	} else {
+		// Drop a previous expiry so the new pin is indefinite
+		_, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{instanceID},
+			Tags:      []types.Tag{{Key: aws.String(PinnedUntilTag)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear pin expiry on instance %s: %w", instanceID, err)
+		}
+	}
+
+	_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{instanceID},
+		Tags:      tags,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pin instance %s: %w", instanceID, err)
+	}
+
+	return nil
+}
+
+// UnpinInstance removes the pin tags from an instance
+func UnpinInstance(ctx context.Context, client *ec2.Client, instanceID string) error {
+	_, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{instanceID},
+		Tags: []types.Tag{
+			{Key: aws.String(PinnedTag)},
+			{Key: aws.String(PinnedUntilTag)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unpin instance %s: %w", instanceID, err)
+	}
+
+	return nil
+}
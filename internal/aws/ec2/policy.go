@@ -0,0 +1,251 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// TimeoutSecondsTag holds the number of idle seconds before the monitor archives the instance
+	TimeoutSecondsTag = "TimeoutSeconds"
+
+	// TTLSecondsTag holds the number of seconds after boot at which the instance is archived
+	TTLSecondsTag = "TTLSeconds"
+
+	// ScheduleTag holds the daily UTC time (HH:MM) at which the instance is archived
+	ScheduleTag = "Schedule"
+
+	// RetainLastTag holds how many archive snapshots of the profile are kept
+	RetainLastTag = "RetainLast"
+
+	// RetainDaysTag holds how many days archive snapshots of the profile are kept; it takes
+	// precedence over RetainLastTag
+	RetainDaysTag = "RetainDays"
+
+	// DefaultTimeoutSeconds is the idle timeout used when none is configured
+	DefaultTimeoutSeconds = 60
+
+	// DefaultRetainLast is the number of snapshots kept when no retention is configured
+	DefaultRetainLast = 3
+)
+
+// Policy is the archive policy the on-instance monitor reads from the instance tags
+type Policy struct {
+	TimeoutSeconds int
+	TTL            time.Duration
+	Schedule       string
+	RetainLast     int
+	RetainDays     int
+	Encryption     Encryption
+	Ports          []PortRule
+}
+
+// PolicyUpdate describes a partial policy change; nil fields are left untouched
+type PolicyUpdate struct {
+	TimeoutSeconds *int
+	TTL            *time.Duration
+	Schedule       *string
+	RetainLast     *int
+	RetainDays     *int
+}
+
+// HasRetention reports whether a retention was configured rather than left to the default
+func (p Policy) HasRetention() bool {
+	return p.RetainLast > 0 || p.RetainDays > 0
+}
+
+// RetentionString describes the snapshot retention for display
+func (p Policy) RetentionString() string {
+	if p.RetainDays > 0 {
+		return fmt.Sprintf("%d days", p.RetainDays)
+	}
+	if p.RetainLast > 0 {
+		return fmt.Sprintf("last %d snapshots", p.RetainLast)
+	}
+	return fmt.Sprintf("last %d snapshots (default)", DefaultRetainLast)
+}
+
+// ParseSchedule validates a daily UTC archive time in HH:MM form
+func ParseSchedule(schedule string) error {
+	if _, err := time.Parse("15:04", schedule); err != nil {
+		return fmt.Errorf("invalid schedule %q (expected HH:MM in UTC): %w", schedule, err)
+	}
+	return nil
+}
+
+// Tags renders the policy as instance tags, omitting disabled triggers
+func (p Policy) Tags() []types.Tag {
+	timeoutSeconds := p.TimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = DefaultTimeoutSeconds
+	}
+
+	tags := []types.Tag{
+		{
+			Key:   aws.String(TimeoutSecondsTag),
+			Value: aws.String(strconv.Itoa(timeoutSeconds)),
+		},
+	}
+	if p.TTL > 0 {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(TTLSecondsTag),
+			Value: aws.String(strconv.Itoa(int(p.TTL.Seconds()))),
+		})
+	}
+	if p.Schedule != "" {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(ScheduleTag),
+			Value: aws.String(p.Schedule),
+		})
+	}
+	if len(p.Ports) > 0 {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(PortsTag),
+			Value: aws.String(FormatPortRules(p.Ports)),
+		})
+	}
+	if p.Encryption != "" {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(EncryptionTag),
+			Value: aws.String(string(p.Encryption)),
+		})
+	}
+	if p.RetainLast > 0 {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(RetainLastTag),
+			Value: aws.String(strconv.Itoa(p.RetainLast)),
+		})
+	}
+	if p.RetainDays > 0 {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(RetainDaysTag),
+			Value: aws.String(strconv.Itoa(p.RetainDays)),
+		})
+	}
+	return tags
+}
+
+// Spec returns the policy as the key/value map the profile registry keeps
+func (p Policy) Spec() map[string]string {
+	spec := map[string]string{}
+	for _, tag := range p.Tags() {
+		spec[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return spec
+}
+
+// GetPolicy extracts the archive policy from a set of instance tags
+func GetPolicy(tags []types.Tag) Policy {
+	policy := Policy{TimeoutSeconds: DefaultTimeoutSeconds}
+	for _, tag := range tags {
+		if tag.Key == nil || tag.Value == nil {
+			continue
+		}
+		switch *tag.Key {
+		case TimeoutSecondsTag:
+			// A non-positive timeout would archive the instance on the first check
+			if v, err := strconv.Atoi(*tag.Value); err == nil && v > 0 {
+				policy.TimeoutSeconds = v
+			}
+		case TTLSecondsTag:
+			if v, err := strconv.Atoi(*tag.Value); err == nil {
+				policy.TTL = time.Duration(v) * time.Second
+			}
+		case ScheduleTag:
+			policy.Schedule = *tag.Value
+		case RetainLastTag:
+			if v, err := strconv.Atoi(*tag.Value); err == nil {
+				policy.RetainLast = v
+			}
+		case RetainDaysTag:
+			if v, err := strconv.Atoi(*tag.Value); err == nil {
+				policy.RetainDays = v
+			}
+		case EncryptionTag:
+			if v, err := ParseEncryption(*tag.Value); err == nil {
+				policy.Encryption = v
+			}
+		case PortsTag:
+			policy.Ports = parsePortRules(*tag.Value)
+		}
+	}
+	return policy
+}
+
+// UpdateInstancePolicy writes a policy change to the instance tags.
+// The on-instance monitor picks it up on its next policy reload.
+func UpdateInstancePolicy(ctx context.Context, client *ec2.Client, instanceID string, update PolicyUpdate) error {
+	var setTags, deleteTags []types.Tag
+
+	if update.TimeoutSeconds != nil {
+		if *update.TimeoutSeconds <= 0 {
+			return fmt.Errorf("invalid timeout %d: it must be a positive number of seconds", *update.TimeoutSeconds)
+		}
+		setTags = append(setTags, types.Tag{
+			Key:   aws.String(TimeoutSecondsTag),
+			Value: aws.String(strconv.Itoa(*update.TimeoutSeconds)),
+		})
+	}
+	if update.TTL != nil {
+		if *update.TTL > 0 {
+			setTags = append(setTags, types.Tag{
+				Key:   aws.String(TTLSecondsTag),
+				Value: aws.String(strconv.Itoa(int(update.TTL.Seconds()))),
+			})
+		} else {
+			deleteTags = append(deleteTags, types.Tag{Key: aws.String(TTLSecondsTag)})
+		}
+	}
+	if update.Schedule != nil {
+		if *update.Schedule != "" {
+			setTags = append(setTags, types.Tag{
+				Key:   aws.String(ScheduleTag),
+				Value: aws.String(*update.Schedule),
+			})
+		} else {
+			deleteTags = append(deleteTags, types.Tag{Key: aws.String(ScheduleTag)})
+		}
+	}
+
+	for key, value := range map[string]*int{RetainLastTag: update.RetainLast, RetainDaysTag: update.RetainDays} {
+		if value == nil {
+			continue
+		}
+		if *value > 0 {
+			setTags = append(setTags, types.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(strconv.Itoa(*value)),
+			})
+		} else {
+			deleteTags = append(deleteTags, types.Tag{Key: aws.String(key)})
+		}
+	}
+
+	if len(setTags) > 0 {
+		_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+			Resources: []string{instanceID},
+			Tags:      setTags,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update policy tags on instance %s: %w", instanceID, err)
+		}
+	}
+
+	if len(deleteTags) > 0 {
+		_, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{instanceID},
+			Tags:      deleteTags,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear policy tags on instance %s: %w", instanceID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,344 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// PortsTag holds the ports opened on the profile security group, which archives carry over
+	PortsTag = "Ports"
+
+	// ProfileTag names the profile a security group belongs to
+	ProfileTag = "Profile"
+
+	// portRuleDescription marks the ingress rules managed by dumie ports
+	portRuleDescription = "dumie-port"
+
+	// maxTagValueLength is the longest value EC2 accepts for a tag
+	maxTagValueLength = 256
+)
+
+// PortRule is a port of the profile instance reachable from a CIDR block
+type PortRule struct {
+	Port     int32
+	Protocol string
+	CIDR     string
+}
+
+// String renders a rule as port/protocol=cidr, the form kept in PortsTag
+func (r PortRule) String() string {
+	return fmt.Sprintf("%d/%s=%s", r.Port, r.Protocol, r.CIDR)
+}
+
+// ParsePort reads a port given as port or port/protocol; the protocol defaults to tcp
+func ParsePort(value string) (int32, string, error) {
+	portValue, protocol, ok := strings.Cut(value, "/")
+	if !ok {
+		protocol = "tcp"
+	}
+	protocol = strings.ToLower(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		return 0, "", fmt.Errorf("invalid protocol %q (expected tcp or udp)", protocol)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, "", fmt.Errorf("invalid port %q (expected 1-65535)", portValue)
+	}
+	return int32(port), protocol, nil
+}
+
+// parsePortRules reads the value of PortsTag, skipping malformed entries
+func parsePortRules(value string) []PortRule {
+	var rules []PortRule
+	for _, field := range strings.Fields(value) {
+		port, cidr, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		number, protocol, err := ParsePort(port)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, PortRule{Port: number, Protocol: protocol, CIDR: cidr})
+	}
+	return rules
+}
+
+// FormatPortRules renders rules as the value of PortsTag. Tag values cannot contain commas or
+// semicolons, so the rules are separated by spaces.
+func FormatPortRules(rules []PortRule) string {
+	fields := make([]string, len(rules))
+	for i, rule := range rules {
+		fields[i] = rule.String()
+	}
+	return strings.Join(fields, " ")
+}
+
+// SortPortRules orders rules by port, protocol and CIDR so tags and listings are stable
+func SortPortRules(rules []PortRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Port != rules[j].Port {
+			return rules[i].Port < rules[j].Port
+		}
+		if rules[i].Protocol != rules[j].Protocol {
+			return rules[i].Protocol < rules[j].Protocol
+		}
+		return rules[i].CIDR < rules[j].CIDR
+	})
+}
+
+func (r PortRule) permission() types.IpPermission {
+	permission := types.IpPermission{
+		IpProtocol: aws.String(r.Protocol),
+		FromPort:   aws.Int32(r.Port),
+		ToPort:     aws.Int32(r.Port),
+	}
+	if strings.Contains(r.CIDR, ":") {
+		permission.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(r.CIDR), Description: aws.String(portRuleDescription)}}
+	} else {
+		permission.IpRanges = []types.IpRange{{CidrIp: aws.String(r.CIDR), Description: aws.String(portRuleDescription)}}
+	}
+	return permission
+}
+
+// ProfileSecurityGroupName returns the name of the security group of a profile
+func ProfileSecurityGroupName(profile string) string {
+	return fmt.Sprintf("dumie-%s-sg", profile)
+}
+
+// CreateOrGetProfileSecurityGroup returns the security group of a profile, creating it without any
+// ingress rule if it does not exist yet
+func CreateOrGetProfileSecurityGroup(ctx context.Context, client *ec2.Client, profile string) (string, error) {
+	groupID, err := GetProfileSecurityGroup(ctx, client, profile)
+	if err != nil || groupID != "" {
+		return groupID, err
+	}
+
+	vpcID, err := GetDefaultVPCID(client)
+	if err != nil {
+		return "", fmt.Errorf("error getting default VPC ID: %w", err)
+	}
+
+	output, err := client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(ProfileSecurityGroupName(profile)),
+		Description: aws.String(fmt.Sprintf("Security Group of Dumie profile %s", profile)),
+		VpcId:       vpcID,
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSecurityGroup,
+				Tags: []types.Tag{
+					{Key: aws.String("ManagedBy"), Value: aws.String("Dumie")},
+					{Key: aws.String(ProfileTag), Value: aws.String(profile)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create security group of profile %s: %w", profile, err)
+	}
+
+	return aws.ToString(output.GroupId), nil
+}
+
+// prepareProfileSecurityGroup returns the security group a profile instance is launched with, with
+// the ports of its policy open
+func prepareProfileSecurityGroup(ctx context.Context, client *ec2.Client, profile string, rules []PortRule) (*string, error) {
+	groupID, err := CreateOrGetProfileSecurityGroup(ctx, client, profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplyPortRules(ctx, client, groupID, rules); err != nil {
+		return nil, err
+	}
+	return aws.String(groupID), nil
+}
+
+// GetProfileSecurityGroup returns the ID of the security group of a profile, or "" if there is none
+func GetProfileSecurityGroup(ctx context.Context, client *ec2.Client, profile string) (string, error) {
+	output, err := client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []string{ProfileSecurityGroupName(profile)},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe security group of profile %s: %w", profile, err)
+	}
+	if len(output.SecurityGroups) == 0 {
+		return "", nil
+	}
+	return aws.ToString(output.SecurityGroups[0].GroupId), nil
+}
+
+// DeleteProfileSecurityGroup removes the security group of a profile if it has one
+func DeleteProfileSecurityGroup(ctx context.Context, client *ec2.Client, profile string) error {
+	groupID, err := GetProfileSecurityGroup(ctx, client, profile)
+	if err != nil || groupID == "" {
+		return err
+	}
+
+	_, err = client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{GroupId: aws.String(groupID)})
+	if err != nil {
+		return fmt.Errorf("failed to delete security group %s of profile %s: %w", groupID, profile, err)
+	}
+
+	fmt.Printf("Security group [%s] of profile [%s] deleted\n", groupID, profile)
+	return nil
+}
+
+// ApplyPortRules makes the port rules of a security group match rules, leaving the SSH rules of
+// AllowSSH and rules added by hand alone
+func ApplyPortRules(ctx context.Context, client *ec2.Client, groupID string, rules []PortRule) error {
+	output, err := client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{groupID}})
+	if err != nil {
+		return fmt.Errorf("failed to describe security group %s: %w", groupID, err)
+	}
+	if len(output.SecurityGroups) == 0 {
+		return fmt.Errorf("security group %s not found", groupID)
+	}
+
+	want := map[PortRule]bool{}
+	for _, rule := range rules {
+		want[rule] = true
+	}
+
+	var revoke []types.IpPermission
+	for _, rule := range portRules(output.SecurityGroups[0]) {
+		if want[rule] {
+			delete(want, rule)
+			continue
+		}
+		revoke = append(revoke, rule.permission())
+	}
+
+	if len(revoke) > 0 {
+		_, err := client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: revoke,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to close ports on security group %s: %w", groupID, err)
+		}
+	}
+
+	var authorize []types.IpPermission
+	for _, rule := range rules {
+		if want[rule] {
+			authorize = append(authorize, rule.permission())
+		}
+	}
+	if len(authorize) > 0 {
+		_, err := client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: authorize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to open ports on security group %s: %w", groupID, err)
+		}
+	}
+
+	return nil
+}
+
+// portRules returns the ingress rules of a security group that ApplyPortRules manages
+func portRules(group types.SecurityGroup) []PortRule {
+	var rules []PortRule
+	for _, permission := range group.IpPermissions {
+		protocol := aws.ToString(permission.IpProtocol)
+		port := aws.ToInt32(permission.FromPort)
+		if port != aws.ToInt32(permission.ToPort) {
+			continue
+		}
+		for _, r := range permission.IpRanges {
+			if aws.ToString(r.Description) == portRuleDescription {
+				rules = append(rules, PortRule{Port: port, Protocol: protocol, CIDR: aws.ToString(r.CidrIp)})
+			}
+		}
+		for _, r := range permission.Ipv6Ranges {
+			if aws.ToString(r.Description) == portRuleDescription {
+				rules = append(rules, PortRule{Port: port, Protocol: protocol, CIDR: aws.ToString(r.CidrIpv6)})
+			}
+		}
+	}
+	return rules
+}
+
+// AttachSecurityGroup adds a security group to an instance, keeping the groups it already has
+func AttachSecurityGroup(ctx context.Context, client *ec2.Client, instanceID, groupID string) error {
+	output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+	if err != nil {
+		return fmt.Errorf("failed to describe instance %s: %w", instanceID, err)
+	}
+	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	groups := []string{groupID}
+	for _, group := range output.Reservations[0].Instances[0].SecurityGroups {
+		if aws.ToString(group.GroupId) == groupID {
+			return nil
+		}
+		groups = append(groups, aws.ToString(group.GroupId))
+	}
+
+	_, err = client.ModifyInstanceAttribute(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId: aws.String(instanceID),
+		Groups:     groups,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to attach security group %s to instance %s: %w", groupID, instanceID, err)
+	}
+
+	return nil
+}
+
+// SetProfilePorts records the port rules of a profile in PortsTag, on its instance if it has one and
+// otherwise on its latest archive, which the next restore reads them from
+func SetProfilePorts(ctx context.Context, client *ec2.Client, profile, instanceID string, rules []PortRule) error {
+	resource := instanceID
+	if resource == "" {
+		snapshot, err := LatestSnapshot(ctx, client, profile)
+		if err != nil {
+			return fmt.Errorf("failed to find snapshots of profile %s: %w", profile, err)
+		}
+		if snapshot == nil {
+			return fmt.Errorf("profile %s has no instance or snapshot", profile)
+		}
+		resource = aws.ToString(snapshot.SnapshotId)
+	}
+
+	if len(rules) == 0 {
+		_, err := client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+			Resources: []string{resource},
+			Tags:      []types.Tag{{Key: aws.String(PortsTag)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear ports tag on %s: %w", resource, err)
+		}
+		return nil
+	}
+
+	value := FormatPortRules(rules)
+	if len(value) > maxTagValueLength {
+		return fmt.Errorf("too many port rules to record in the %s tag (%d of %d characters)", PortsTag, len(value), maxTagValueLength)
+	}
+	_, err := client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{resource},
+		Tags:      []types.Tag{{Key: aws.String(PortsTag), Value: aws.String(value)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update ports tag on %s: %w", resource, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package ec2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	// SharedWithTag records the account an archive snapshot was shared with
+	SharedWithTag = "SharedWith"
+
+	// ShareCopyOfTag marks a copy re-encrypted for sharing with the snapshot it was copied from.
+	// Such copies are not archives, so they are never restored or pruned.
+	ShareCopyOfTag = "ShareCopyOf"
+
+	// ImportedFromTag records the owner and ID of the snapshot an imported profile was copied from
+	ImportedFromTag = "ImportedFrom"
+)
+
+// ShareSnapshot lets another AWS account create volumes from a snapshot
+func ShareSnapshot(ctx context.Context, client *ec2.Client, snapshotID, accountID string) error {
+	_, err := client.ModifySnapshotAttribute(ctx, &ec2.ModifySnapshotAttributeInput{
+		SnapshotId: aws.String(snapshotID),
+		Attribute:  types.SnapshotAttributeNameCreateVolumePermission,
+		CreateVolumePermission: &types.CreateVolumePermissionModifications{
+			Add: []types.CreateVolumePermission{
+				{UserId: aws.String(accountID)},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to share snapshot %s with account %s: %w", snapshotID, accountID, err)
+	}
+
+	_, err = client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{snapshotID},
+		Tags: []types.Tag{
+			{Key: aws.String(SharedWithTag), Value: aws.String(accountID)},
+		},
+	})
+	if err != nil {
+		fmt.Printf("Warning: failed to tag snapshot [%s] as shared: %v\n", snapshotID, err)
+	}
+
+	return nil
+}
+
+// ReencryptSnapshot copies an archive snapshot in place with another KMS key, such as a customer
+// managed key that can be shared with other accounts. The copy keeps the archive tags and is
+// marked as a share copy, so it does not become the newest archive of the profile.
+func ReencryptSnapshot(ctx context.Context, client *ec2.Client, region, profile string, snapshot types.Snapshot, kmsKeyID string) (string, error) {
+	snapshotID := aws.ToString(snapshot.SnapshotId)
+	description := fmt.Sprintf("Dumie archive of profile %s re-encrypted for sharing", profile)
+	tags := append(copyableTags(snapshot), types.Tag{Key: aws.String(ShareCopyOfTag), Value: aws.String(snapshotID)})
+	return copySnapshot(ctx, client, region, snapshotID, profile, description, tags, kmsKeyID)
+}
+
+// ImportSnapshot copies a snapshot shared by another account from the region of the source client
+// into the region of the client as the newest archive of a profile. An empty kmsKeyID keeps the
+// default encryption of the copy.
+func ImportSnapshot(ctx context.Context, client, sourceClient *ec2.Client, snapshotID, profile, kmsKeyID string) (string, error) {
+	sourceRegion := sourceClient.Options().Region
+	output, err := sourceClient.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []string{snapshotID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe snapshot %s in %s (is it shared with this account?): %w", snapshotID, sourceRegion, err)
+	}
+	if len(output.Snapshots) == 0 {
+		return "", fmt.Errorf("snapshot %s not found or not shared with this account", snapshotID)
+	}
+	source := output.Snapshots[0]
+	if source.State != types.SnapshotStateCompleted {
+		return "", fmt.Errorf("snapshot %s is in state %s", snapshotID, source.State)
+	}
+
+	tags := []types.Tag{
+		{Key: aws.String("Name"), Value: aws.String(profile)},
+		{Key: aws.String("ManagedBy"), Value: aws.String("Dumie")},
+		{Key: aws.String(ImportedFromTag), Value: aws.String(fmt.Sprintf("%s/%s", aws.ToString(source.OwnerId), snapshotID))},
+	}
+
+	description := fmt.Sprintf("Dumie archive of profile %s imported from account %s", profile, aws.ToString(source.OwnerId))
+	return copySnapshot(ctx, client, sourceRegion, snapshotID, profile, description, tags, kmsKeyID)
+}
+
+// copyableTags returns the tags of a snapshot that can be set on a copy
+func copyableTags(snapshot types.Snapshot) []types.Tag {
+	var tags []types.Tag
+	for _, tag := range snapshot.Tags {
+		// Tags in the aws: namespace are reserved
+		if strings.HasPrefix(aws.ToString(tag.Key), "aws:") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// copySnapshot copies a snapshot into the region of the client with the given tags and waits
+// until the copy is a completed archive of the profile. A non-empty kmsKeyID encrypts the copy with that key.
+func copySnapshot(ctx context.Context, client *ec2.Client, sourceRegion, sourceID, profile, description string, tags []types.Tag, kmsKeyID string) (string, error) {
+	input := &ec2.CopySnapshotInput{
+		SourceRegion:     aws.String(sourceRegion),
+		SourceSnapshotId: aws.String(sourceID),
+		Description:      aws.String(description),
+		TagSpecifications: []types.TagSpecification{
+			{
+				ResourceType: types.ResourceTypeSnapshot,
+				Tags:         tags,
+			},
+		},
+	}
+	if kmsKeyID != "" {
+		input.Encrypted = aws.Bool(true)
+		input.KmsKeyId = aws.String(kmsKeyID)
+	}
+
+	output, err := client.CopySnapshot(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy snapshot %s from %s: %w", sourceID, sourceRegion, err)
+	}
+	copyID := aws.ToString(output.SnapshotId)
+
+	if err := WaitForArchiveSnapshot(ctx, client, copyID, profile); err != nil {
+		return "", err
+	}
+
+	return copyID, nil
+}
@@ -3,6 +3,8 @@ package ec2
 import (
 	"context"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -10,52 +12,33 @@ import (
 	"github.com/dumie-org/dumie-cli/internal/aws/common"
 )
 
-type SnapshotManager struct {
-	Client *ec2.Client
-}
-
-func NewSnapshotManagerFromClient(client *ec2.Client) *SnapshotManager {
-	return &SnapshotManager{
-		Client: client,
-	}
-}
+const (
+	// imageAvailableTimeout bounds how long archiving waits for a new AMI
+	imageAvailableTimeout = 30 * time.Minute
 
-func (s *SnapshotManager) CreateSnapshot(ctx context.Context, volumeID, instanceID, profile string) (string, error) {
-	input := &ec2.CreateSnapshotInput{
-		VolumeId:    aws.String(volumeID),
-		Description: aws.String(fmt.Sprintf("Snapshot before deleting instance %s", instanceID)),
-		TagSpecifications: []types.TagSpecification{
-			{
-				ResourceType: types.ResourceTypeSnapshot,
-				Tags: []types.Tag{
-					{
-						Key:   aws.String("Name"),
-						Value: aws.String(profile),
-					},
-					{
-						Key:   aws.String("InstanceID"),
-						Value: aws.String(instanceID),
-					},
-					{
-						Key:   aws.String("ManagedBy"),
-						Value: aws.String("Dumie"),
-					},
-				},
-			},
-		},
-	}
+	// snapshotCompletedTimeout bounds how long archiving waits for a snapshot to complete
+	snapshotCompletedTimeout = 2 * time.Hour
+)
 
-	result, err := s.Client.CreateSnapshot(ctx, input)
+// ListProfileSnapshots returns the archive snapshots of a profile, newest first
+func ListProfileSnapshots(ctx context.Context, client *ec2.Client, profile string) ([]types.Snapshot, error) {
+	snapshots, err := listProfileSnapshots(ctx, client, profile)
 	if err != nil {
-		return "", fmt.Errorf("failed to create snapshot: %w", err)
+		return nil, err
 	}
 
-	return *result.SnapshotId, nil
+	archives := snapshots[:0]
+	for _, snap := range snapshots {
+		if tagValue(snap.Tags, ShareCopyOfTag) == "" {
+			archives = append(archives, snap)
+		}
+	}
+	return archives, nil
 }
 
-func TryRestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile string, iamRoleARN *string, timeoutSeconds int) (string, error) {
-	// Find Snapshot (tag:Name = profile)
-	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
+// listProfileSnapshots returns every snapshot tagged for a profile, share copies included, newest first
+func listProfileSnapshots(ctx context.Context, client *ec2.Client, profile string) ([]types.Snapshot, error) {
+	input := &ec2.DescribeSnapshotsInput{
 		Filters: []types.Filter{
 			{
 				Name:   aws.String("tag:Name"),
@@ -69,17 +52,108 @@ func TryRestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile str
 		OwnerIds: []string{"self"},
 	}
 
-	result, err := client.DescribeSnapshots(ctx, describeSnapshotsInput)
+	var snapshots []types.Snapshot
+	paginator := ec2.NewDescribeSnapshotsPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe snapshots: %w", err)
+		}
+		snapshots = append(snapshots, page.Snapshots...)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return aws.ToTime(snapshots[i].StartTime).After(aws.ToTime(snapshots[j].StartTime))
+	})
+	return snapshots, nil
+}
+
+// LatestSnapshot returns the newest completed archive snapshot of a profile, or nil if there is none
+func LatestSnapshot(ctx context.Context, client *ec2.Client, profile string) (*types.Snapshot, error) {
+	snapshots, err := ListProfileSnapshots(ctx, client, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range snapshots {
+		if snapshots[i].State == types.SnapshotStateCompleted {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func TryRestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile string, iamRoleARN *string, policy Policy) (string, error) {
+	snapshot, err := LatestSnapshot(ctx, client, profile)
 	if err != nil {
 		return "", fmt.Errorf("failed to search snapshot: %w", err)
 	}
 
-	if len(result.Snapshots) == 0 { // No matching snapshot found for profile
+	if snapshot == nil { // No completed snapshot found for profile
 		return "", nil
 	}
 
-	snapshotID := *result.Snapshots[0].SnapshotId
-	fmt.Println("Found snapshot for profile. Registering AMI from snapshot:", snapshotID)
+	fmt.Println("Found snapshot for profile:", *snapshot.SnapshotId)
+	return RestoreFromSnapshot(ctx, client, profile, *snapshot, iamRoleARN, policy)
+}
+
+// GetProfileSnapshot returns an archive snapshot by ID after checking it belongs to the profile
+func GetProfileSnapshot(ctx context.Context, client *ec2.Client, profile, snapshotID string) (*types.Snapshot, error) {
+	output, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []string{snapshotID},
+		OwnerIds:    []string{"self"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe snapshot %s: %w", snapshotID, err)
+	}
+	if len(output.Snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+
+	snapshot := output.Snapshots[0]
+	name, managedBy := "", ""
+	for _, tag := range snapshot.Tags {
+		if tag.Key == nil || tag.Value == nil {
+			continue
+		}
+		switch *tag.Key {
+		case "Name":
+			name = *tag.Value
+		case "ManagedBy":
+			managedBy = *tag.Value
+		}
+	}
+	if name != profile || managedBy != "Dumie" {
+		return nil, fmt.Errorf("snapshot %s is not a Dumie snapshot of profile %s", snapshotID, profile)
+	}
+
+	return &snapshot, nil
+}
+
+// RestoreFromSnapshot launches an instance for the profile from one of its archive snapshots
+func RestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile string, snapshot types.Snapshot, iamRoleARN *string, policy Policy) (string, error) {
+	if snapshot.State != types.SnapshotStateCompleted {
+		return "", fmt.Errorf("snapshot %s is in state %s", aws.ToString(snapshot.SnapshotId), snapshot.State)
+	}
+
+	// Keep the retention, encryption and ports of the archived instance unless new ones were given
+	archived := GetPolicy(snapshot.Tags)
+	if policy.Ports == nil {
+		policy.Ports = archived.Ports
+	}
+	if !policy.HasRetention() {
+		policy.RetainLast = archived.RetainLast
+		policy.RetainDays = archived.RetainDays
+	}
+	if policy.Encryption == "" {
+		policy.Encryption = archived.Encryption
+	}
+	if policy.Encryption == "" {
+		policy.Encryption = DefaultEncryption()
+	}
+
+	snapshotID := *snapshot.SnapshotId
+	fmt.Println("Registering AMI from snapshot:", snapshotID)
 
 	// Register AMI
 	amiID, err := RegisterAMIFromSnapshot(ctx, client, snapshotID)
@@ -87,8 +161,17 @@ func TryRestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile str
 		return "", fmt.Errorf("failed to register AMI from snapshot: %w", err)
 	}
 
+	// The AMI is only needed to launch; the instance keeps its own volume. It is removed even if
+	// the launch failed or was interrupted.
+	defer func() {
+		_, err := client.DeregisterImage(context.WithoutCancel(ctx), &ec2.DeregisterImageInput{ImageId: aws.String(amiID)})
+		if err != nil {
+			fmt.Printf("Warning: failed to deregister restore AMI [%s]: %v\n", amiID, err)
+		}
+	}()
+
 	// Get SecurityGroup
-	sgID, err := CreateOrGetSecurityGroup(client, "dumie-default-sg")
+	sgID, err := prepareProfileSecurityGroup(ctx, client, profile, policy.Ports)
 	if err != nil {
 		return "", fmt.Errorf("failed to get SG: %w", err)
 	}
@@ -100,32 +183,25 @@ func TryRestoreFromSnapshot(ctx context.Context, client *ec2.Client, profile str
 	}
 
 	// Launch EC2 Instance
-	instanceIDPtr, err := LaunchEC2Instance(client, InstanceOptions{
-		Profile:        profile,
-		AMIID:          amiID,
-		InstanceType:   types.InstanceTypeT2Micro,
-		SecurityGroup:  sgID,
-		KeyName:        keyName,
-		UserDataPath:   nil, // No user data for restored instances
-		IAMRoleARN:     iamRoleARN,
-		Restored:       true,
-		TimeoutSeconds: timeoutSeconds,
+	instanceIDPtr, err := LaunchEC2Instance(ctx, client, InstanceOptions{
+		Profile:       profile,
+		AMIID:         amiID,
+		InstanceType:  types.InstanceTypeT2Micro,
+		SecurityGroup: sgID,
+		KeyName:       keyName,
+		UserData:      nil, // No user data for restored instances
+		IAMRoleARN:    iamRoleARN,
+		Restored:      true,
+		RestoredFrom:  snapshotID,
+		Policy:        policy,
 	})
 	if err != nil {
 		return "", fmt.Errorf("failed to launch instance: %w", err)
 	}
 
-	// Update timeout in the running instance
-	err = UpdateInstanceTimeout(ctx, client, *instanceIDPtr, timeoutSeconds)
-	if err != nil {
-		fmt.Printf("Warning: failed to update timeout: %v\n", err)
-	}
-
 	return *instanceIDPtr, nil
 }
 
-
-
 func DeleteSnapshotAndAMIIfExists(ctx context.Context, client *ec2.Client, snapshotID string, profile string) error {
 	// check AMI using the snapshot
 	describeInput := &ec2.DescribeImagesInput{
@@ -167,37 +243,107 @@ func DeleteSnapshotAndAMIIfExists(ctx context.Context, client *ec2.Client, snaps
 	return nil
 }
 
-func DeleteOldSnapshotsByProfile(ctx context.Context, profile string) error {
-	client, err := common.GetEC2AWSClient()
+// PruneSnapshots deletes the archive snapshots of a profile that fall outside its retention.
+// The newest completed snapshot is always kept, and snapshots still in progress are never touched.
+func PruneSnapshots(ctx context.Context, client *ec2.Client, profile string, policy Policy) error {
+	snapshots, err := ListProfileSnapshots(ctx, client, profile)
 	if err != nil {
-		return fmt.Errorf("failed to create EC2 client: %w", err)
+		return err
 	}
 
-	input := &ec2.DescribeSnapshotsInput{
-		Filters: []types.Filter{
-			{
-				Name:   aws.String("tag:Name"),
-				Values: []string{profile},
-			},
-			{
-				Name:   aws.String("tag:ManagedBy"),
-				Values: []string{"Dumie"},
-			},
-		},
-		OwnerIds: []string{"self"},
+	var completed []types.Snapshot
+	for _, snap := range snapshots {
+		if snap.State == types.SnapshotStateCompleted {
+			completed = append(completed, snap)
+		}
 	}
 
-	result, err := client.DescribeSnapshots(ctx, input)
+	for i, snap := range completed {
+		if i == 0 || !expired(policy, i, aws.ToTime(snap.StartTime)) {
+			continue
+		}
+		if err := DeleteSnapshotAndAMIIfExists(ctx, client, *snap.SnapshotId, profile); err != nil {
+			fmt.Printf("Warning: failed to delete snapshot [%s]: %v\n", *snap.SnapshotId, err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteProfileSnapshots deletes every archive snapshot of a profile and its share copies
+func DeleteProfileSnapshots(ctx context.Context, client *ec2.Client, profile string) error {
+	snapshots, err := listProfileSnapshots(ctx, client, profile)
 	if err != nil {
-		return fmt.Errorf("failed to describe snapshots: %w", err)
+		return err
 	}
 
-	for _, snap := range result.Snapshots {
-		err := DeleteSnapshotAndAMIIfExists(ctx, client, *snap.SnapshotId, profile)
-		if err != nil {
+	for _, snap := range snapshots {
+		if err := DeleteSnapshotAndAMIIfExists(ctx, client, *snap.SnapshotId, profile); err != nil {
 			fmt.Printf("Warning: failed to delete snapshot [%s]: %v\n", *snap.SnapshotId, err)
 		}
 	}
 
 	return nil
 }
+
+// expired reports whether the snapshot at position index (newest first) falls outside the retention
+func expired(policy Policy, index int, startTime time.Time) bool {
+	if policy.RetainDays > 0 {
+		return time.Since(startTime) > time.Duration(policy.RetainDays)*24*time.Hour
+	}
+
+	retainLast := policy.RetainLast
+	if retainLast <= 0 {
+		retainLast = DefaultRetainLast
+	}
+	return index >= retainLast
+}
+
+// PruneProfileSnapshots prunes the snapshots of a profile with the retention of its current instance
+func PruneProfileSnapshots(ctx context.Context, client *ec2.Client, profile string) error {
+	instance, err := FindLatestInstance(ctx, client, profile)
+	if err != nil {
+		return err
+	}
+
+	policy := Policy{}
+	if instance != nil {
+		policy = GetPolicy(instance.Tags)
+	}
+	return PruneSnapshots(ctx, client, profile, policy)
+}
+
+// WaitForArchiveSnapshot waits until a snapshot is completed and confirms that it is tagged for
+// the profile. An instance must only be terminated once this returns nil.
+func WaitForArchiveSnapshot(ctx context.Context, client *ec2.Client, snapshotID, profile string) error {
+	if err := common.WaitForSnapshotCompleted(ctx, client, snapshotID, snapshotCompletedTimeout); err != nil {
+		return fmt.Errorf("snapshot %s did not complete: %w", snapshotID, err)
+	}
+
+	output, err := client.DescribeSnapshots(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []string{snapshotID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe snapshot %s: %w", snapshotID, err)
+	}
+	if len(output.Snapshots) == 0 {
+		return fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+
+	snap := output.Snapshots[0]
+	if snap.State != types.SnapshotStateCompleted {
+		return fmt.Errorf("snapshot %s is in state %s", snapshotID, snap.State)
+	}
+
+	tagged := false
+	for _, tag := range snap.Tags {
+		if tag.Key != nil && tag.Value != nil && *tag.Key == "Name" && *tag.Value == profile {
+			tagged = true
+		}
+	}
+	if !tagged {
+		return fmt.Errorf("snapshot %s is not tagged for profile %s", snapshotID, profile)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package ec2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// sshRulePrefix starts the description of every SSH rule Dumie adds for a user
+	sshRulePrefix = "dumie:"
+
+	// sshRuleRefreshAfter is how old a rule may get before its timestamp is refreshed
+	sshRuleRefreshAfter = time.Hour
+)
+
+// sshRange is one address range allowed to reach port 22
+type sshRange struct {
+	CIDR        string
+	IPv6        bool
+	Description string
+}
+
+// sshRuleDescription labels a rule with its owner and when it was last refreshed
+func sshRuleDescription(owner string, at time.Time) string {
+	return fmt.Sprintf("%s%s:%s", sshRulePrefix, owner, at.UTC().Format(time.RFC3339))
+}
+
+// parseSSHRuleDescription reads a description written by sshRuleDescription
+func parseSSHRuleDescription(description string) (string, time.Time, bool) {
+	rest, ok := strings.CutPrefix(description, sshRulePrefix)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	// The timestamp contains colons itself, so the owner ends at the first one
+	owner, stamp, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	at, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return owner, at, true
+}
+
+func (r sshRange) permission() types.IpPermission {
+	permission := types.IpPermission{
+		IpProtocol: aws.String("tcp"),
+		FromPort:   aws.Int32(22),
+		ToPort:     aws.Int32(22),
+	}
+	if r.IPv6 {
+		permission.Ipv6Ranges = []types.Ipv6Range{{CidrIpv6: aws.String(r.CIDR), Description: aws.String(r.Description)}}
+	} else {
+		permission.IpRanges = []types.IpRange{{CidrIp: aws.String(r.CIDR), Description: aws.String(r.Description)}}
+	}
+	return permission
+}
+
+// sshRanges returns the ranges a security group allows to reach port 22 through rules for port 22 only
+func sshRanges(group types.SecurityGroup) []sshRange {
+	var ranges []sshRange
+	for _, permission := range group.IpPermissions {
+		if aws.ToString(permission.IpProtocol) != "tcp" || aws.ToInt32(permission.FromPort) != 22 || aws.ToInt32(permission.ToPort) != 22 {
+			continue
+		}
+		for _, r := range permission.IpRanges {
+			ranges = append(ranges, sshRange{CIDR: aws.ToString(r.CidrIp), Description: aws.ToString(r.Description)})
+		}
+		for _, r := range permission.Ipv6Ranges {
+			ranges = append(ranges, sshRange{CIDR: aws.ToString(r.CidrIpv6), IPv6: true, Description: aws.ToString(r.Description)})
+		}
+	}
+	return ranges
+}
+
+// AllowSSH grants owner SSH access to a security group from cidr only. The owner's rules for other
+// addresses, Dumie rules not refreshed within maxAge and rules open to the whole internet are revoked,
+// unless port 22 was opened on purpose with ApplyPortRules. Other rules added by hand are left alone.
+func AllowSSH(ctx context.Context, client *ec2.Client, groupID, cidr, owner string, maxAge time.Duration) error {
+	output, err := client.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{groupID}})
+	if err != nil {
+		return fmt.Errorf("failed to describe security group %s: %w", groupID, err)
+	}
+	if len(output.SecurityGroups) == 0 {
+		return fmt.Errorf("security group %s not found", groupID)
+	}
+
+	now := time.Now()
+	found := false
+	var revoke []types.IpPermission
+	for _, r := range sshRanges(output.SecurityGroups[0]) {
+		if (r.CIDR == "0.0.0.0/0" || r.CIDR == "::/0") && r.Description != portRuleDescription {
+			fmt.Printf("Closing SSH access from %s on security group [%s]\n", r.CIDR, groupID)
+			revoke = append(revoke, r.permission())
+			continue
+		}
+
+		ruleOwner, refreshed, ok := parseSSHRuleDescription(r.Description)
+		switch {
+		case !ok:
+			continue
+		case ruleOwner == owner && r.CIDR == cidr:
+			found = true
+			if now.Sub(refreshed) < sshRuleRefreshAfter {
+				continue
+			}
+			refreshedRange := r
+			refreshedRange.Description = sshRuleDescription(owner, now)
+			_, err := client.UpdateSecurityGroupRuleDescriptionsIngress(ctx, &ec2.UpdateSecurityGroupRuleDescriptionsIngressInput{
+				GroupId:       aws.String(groupID),
+				IpPermissions: []types.IpPermission{refreshedRange.permission()},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to refresh SSH rule for %s: %w", cidr, err)
+			}
+		case ruleOwner == owner:
+			fmt.Printf("Your IP changed, revoking SSH access from %s\n", r.CIDR)
+			revoke = append(revoke, r.permission())
+		case now.Sub(refreshed) > maxAge:
+			fmt.Printf("Revoking stale SSH access of %s from %s (last used %s)\n", ruleOwner, r.CIDR, refreshed.Local().Format("2006-01-02"))
+			revoke = append(revoke, r.permission())
+		case r.CIDR == cidr:
+			// Someone else behind the same address already allows it, and EC2 refuses a duplicate rule
+			found = true
+		}
+	}
+
+	if len(revoke) > 0 {
+		_, err := client.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(groupID),
+			IpPermissions: revoke,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to revoke SSH rules: %w", err)
+		}
+	}
+
+	if found {
+		return nil
+	}
+
+	fmt.Printf("Allowing SSH access from %s on security group [%s]\n", cidr, groupID)
+	allowed := sshRange{CIDR: cidr, IPv6: strings.Contains(cidr, ":"), Description: sshRuleDescription(owner, now)}
+	_, err = client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       aws.String(groupID),
+		IpPermissions: []types.IpPermission{allowed.permission()},
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPermission.Duplicate" {
+		// Another command allowed the same address in the meantime
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to allow SSH access from %s: %w", cidr, err)
+	}
+
+	return nil
+}
+
+// AllowSSHToInstance applies AllowSSH to the Dumie security groups of an instance
+func AllowSSHToInstance(ctx context.Context, client *ec2.Client, instanceID, cidr, owner string, maxAge time.Duration) error {
+	output, err := client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{instanceID}})
+	if err != nil {
+		return fmt.Errorf("failed to describe instance %s: %w", instanceID, err)
+	}
+	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("instance %s not found", instanceID)
+	}
+
+	for _, group := range output.Reservations[0].Instances[0].SecurityGroups {
+		if !strings.HasPrefix(aws.ToString(group.GroupName), "dumie-") {
+			continue
+		}
+		if err := AllowSSH(ctx, client, aws.ToString(group.GroupId), cidr, owner, maxAge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
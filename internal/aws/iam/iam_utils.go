@@ -6,13 +6,16 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 )
 
 const (
-	roleName       = "DumieInstanceManagerRole"
-	profileName    = "DumieInstanceManagerProfile"
-	policyName     = "DumieInstanceManagerPolicy"
-	policyDocument = `{
+	roleName    = "DumieInstanceManagerRole"
+	profileName = "DumieInstanceManagerProfile"
+	policyName  = "DumieInstanceManagerPolicy"
+
+	// policyDocumentTemplate is the policy of the instance manager role; %s is the lock table
+	policyDocumentTemplate = `{
 		"Version": "2012-10-17",
 		"Statement": [
 			{
@@ -27,20 +30,39 @@ const (
 					"ec2:DescribeVolumes",
 					"ec2:CreateSnapshot",
 					"ec2:DeleteSnapshot",
-					"ec2:DescribeSnapshots"
+					"ec2:DescribeSnapshots",
+					"ec2:CopySnapshot"
 				],
 				"Resource": "*"
 			},
+			{
+				"Effect": "Allow",
+				"Action": [
+					"kms:CreateGrant",
+					"kms:Decrypt",
+					"kms:DescribeKey",
+					"kms:Encrypt",
+					"kms:GenerateDataKeyWithoutPlaintext",
+					"kms:ReEncrypt*"
+				],
+				"Resource": "*",
+				"Condition": {
+					"StringLike": {
+						"kms:ViaService": "ec2.*.amazonaws.com"
+					}
+				}
+			},
 			{
 				"Effect": "Allow",
 				"Action": [
 					"dynamodb:PutItem",
 					"dynamodb:GetItem",
 					"dynamodb:DeleteItem",
+					"dynamodb:UpdateItem",
 					"dynamodb:DescribeTable",
 					"dynamodb:CreateTable"
 				],
-				"Resource": "arn:aws:dynamodb:*:*:table/dumie-lock-table"
+				"Resource": "arn:aws:dynamodb:*:*:table/%s"
 			}
 		]
 	}`
@@ -58,8 +80,14 @@ const (
 	}`
 )
 
-// CreateInstanceManagerRole creates an IAM role and instance profile for EC2 instances to manage themselves
-func CreateInstanceManagerRole(client *iam.Client) error {
+// policyDocument returns the policy of the instance manager role for a lock table
+func policyDocument(lockTable string) string {
+	return fmt.Sprintf(policyDocumentTemplate, lockTable)
+}
+
+// CreateInstanceManagerRole creates an IAM role and instance profile for EC2 instances to manage
+// themselves, with access to the given lock table
+func CreateInstanceManagerRole(client *iam.Client, lockTable string) error {
 	ctx := context.TODO()
 
 	// Check if role already exists
@@ -68,6 +96,9 @@ func CreateInstanceManagerRole(client *iam.Client) error {
 	})
 	if err == nil {
 		fmt.Printf("IAM role %s already exists\n", roleName)
+		if err := updateInstanceManagerPolicy(ctx, client, policyDocument(lockTable)); err != nil {
+			return err
+		}
 	} else {
 		// Create the role
 		createRoleInput := &iam.CreateRoleInput{
@@ -84,7 +115,7 @@ func CreateInstanceManagerRole(client *iam.Client) error {
 		// Create the policy
 		createPolicyInput := &iam.CreatePolicyInput{
 			PolicyName:     aws.String(policyName),
-			PolicyDocument: aws.String(policyDocument),
+			PolicyDocument: aws.String(policyDocument(lockTable)),
 			Description:    aws.String("Policy for Dumie instance management"),
 		}
 
@@ -142,6 +173,61 @@ func CreateInstanceManagerRole(client *iam.Client) error {
 	return nil
 }
 
+// updateInstanceManagerPolicy brings the policy of an existing role up to date with document,
+// so permissions added in newer versions and a changed lock table reach roles created earlier
+func updateInstanceManagerPolicy(ctx context.Context, client *iam.Client, document string) error {
+	attached, err := client.ListAttachedRolePolicies(ctx, &iam.ListAttachedRolePoliciesInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list policies of role %s: %w", roleName, err)
+	}
+
+	for _, policy := range attached.AttachedPolicies {
+		if aws.ToString(policy.PolicyName) != policyName {
+			continue
+		}
+
+		// A policy keeps at most five versions, so drop the oldest non-default one first
+		versions, err := client.ListPolicyVersions(ctx, &iam.ListPolicyVersionsInput{PolicyArn: policy.PolicyArn})
+		if err != nil {
+			return fmt.Errorf("failed to list versions of policy %s: %w", policyName, err)
+		}
+		if len(versions.Versions) >= 5 {
+			var oldest *types.PolicyVersion
+			for i, version := range versions.Versions {
+				if version.IsDefaultVersion {
+					continue
+				}
+				if oldest == nil || aws.ToTime(version.CreateDate).Before(aws.ToTime(oldest.CreateDate)) {
+					oldest = &versions.Versions[i]
+				}
+			}
+			if oldest != nil {
+				_, err := client.DeletePolicyVersion(ctx, &iam.DeletePolicyVersionInput{
+					PolicyArn: policy.PolicyArn,
+					VersionId: oldest.VersionId,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to delete old version of policy %s: %w", policyName, err)
+				}
+			}
+		}
+
+		_, err = client.CreatePolicyVersion(ctx, &iam.CreatePolicyVersionInput{
+			PolicyArn:      policy.PolicyArn,
+			PolicyDocument: aws.String(document),
+			SetAsDefault:   true,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update policy %s: %w", policyName, err)
+		}
+		fmt.Printf("Updated IAM policy %s\n", policyName)
+	}
+
+	return nil
+}
+
 // GetInstanceManagerRoleARN returns the ARN of the instance manager role
 func GetInstanceManagerRoleARN(client *iam.Client) (string, error) {
 	ctx := context.TODO()
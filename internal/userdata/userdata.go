@@ -0,0 +1,59 @@
+package userdata
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var templates embed.FS
+
+// DefaultTemplate is the embedded template that installs the Dumie agent
+const DefaultTemplate = "dumie_agent.sh.tmpl"
+
+// Params are the values available to a user data template
+type Params struct {
+	Profile        string
+	Region         string
+	LockTable      string
+	TimeoutSeconds int
+	// AgentVersion is the release the agent is installed from, empty to skip the agent
+	AgentVersion     string
+	AgentSHA256AMD64 string
+	AgentSHA256ARM64 string
+}
+
+var funcs = template.FuncMap{
+	"quote": shellQuote,
+}
+
+// Render renders the user data for an instance. When overridePath is set, the template
+// is read from that file instead of the embedded default.
+func Render(params Params, overridePath string) (string, error) {
+	var tmpl *template.Template
+	var err error
+	if overridePath != "" {
+		tmpl, err = template.New(filepath.Base(overridePath)).Funcs(funcs).ParseFiles(overridePath)
+	} else {
+		tmpl, err = template.New(DefaultTemplate).Funcs(funcs).ParseFS(templates, "templates/"+DefaultTemplate)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to parse user data template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("failed to render user data template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// shellQuote wraps a value in single quotes so it is safe to embed in a shell script
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
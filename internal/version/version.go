@@ -0,0 +1,17 @@
+package version
+
+// Version is the Dumie release version, set at build time with
+// -ldflags "-X github.com/dumie-org/dumie-cli/internal/version.Version=v1.2.3"
+var Version = "dev"
+
+// AgentSHA256AMD64 and AgentSHA256ARM64 are the SHA-256 checksums of the agent binaries of this
+// release, set at build time like Version. Instances refuse an agent download that does not match.
+var (
+	AgentSHA256AMD64 = ""
+	AgentSHA256ARM64 = ""
+)
+
+// Released reports whether this build is a release whose agent binaries can be verified
+func Released() bool {
+	return Version != "dev" && AgentSHA256AMD64 != "" && AgentSHA256ARM64 != ""
+}